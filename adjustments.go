@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// Colour and tone adjustments of the result. Brightness, contrast and
+// saturation are in percents in range -100..100, zero keeps the image
+// as is. Gamma is in range 0.1..10, more than one makes the image
+// lighter.
+type adjustParams struct {
+	brightness float64
+	contrast   float64
+	saturation float64
+	gamma      float64
+	grayscale  bool
+	sepia      bool
+}
+
+const (
+	minGamma = 0.1
+	maxGamma = 10.0
+)
+
+// Parses `brightness`, `contrast`, `saturation`, `gamma`, `grayscale`
+// and `sepia` parameters. Returns nil when nothing is adjusted.
+func parseAdjustments(args url.Values) (*adjustParams, error) {
+	p := &adjustParams{gamma: 1}
+	var err error
+	for _, opt := range []struct {
+		name string
+		dst  *float64
+	}{{"brightness", &p.brightness}, {"contrast", &p.contrast}, {"saturation", &p.saturation}} {
+		if args.Get(opt.name) == "" {
+			continue
+		}
+		if *opt.dst, err = parseFloat(args.Get(opt.name)); err != nil || *opt.dst < -100 || *opt.dst > 100 {
+			return nil, fmt.Errorf("`%s` should be in range -100..100", opt.name)
+		}
+	}
+	if args.Get("gamma") != "" {
+		if p.gamma, err = parseFloat(args.Get("gamma")); err != nil || p.gamma < minGamma || p.gamma > maxGamma {
+			return nil, fmt.Errorf("`gamma` should be in range %g..%g", minGamma, maxGamma)
+		}
+	}
+	for _, opt := range []struct {
+		name string
+		dst  *bool
+	}{{"grayscale", &p.grayscale}, {"sepia", &p.sepia}} {
+		if args.Get(opt.name) == "" {
+			continue
+		}
+		if *opt.dst, err = strconv.ParseBool(args.Get(opt.name)); err != nil {
+			return nil, fmt.Errorf("`%s` should be 0 or 1", opt.name)
+		}
+	}
+	if p.grayscale && p.sepia {
+		return nil, errors.New("`grayscale` and `sepia` could not be combined")
+	}
+	if *p == (adjustParams{gamma: 1}) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Parses the finite number. NaN and infinities pass any range checks
+// so they are refused here.
+func parseFloat(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+	return v, err
+}
+
+// Part of the cache key.
+func (p *adjustParams) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g,%t,%t", p.brightness, p.contrast, p.saturation, p.gamma, p.grayscale, p.sepia)
+}
+
+// Applies the adjustments pixel by pixel. Brightness, contrast and
+// gamma are the same for each channel so they are looked up in the
+// table, saturation and the tones mix the channels. Alpha is kept.
+func applyAdjustments(img image.Image, p *adjustParams) image.Image {
+	var table [256]float64
+	for i := range table {
+		v := float64(i) + p.brightness*255/100
+		v = (v-128)*(1+p.contrast/100) + 128
+		if p.gamma != 1 {
+			v = 255 * math.Pow(clampChannel(v)/255, 1/p.gamma)
+		}
+		table[i] = clampChannel(v)
+	}
+	saturation := 1 + p.saturation/100
+
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+4*bounds.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := table[row[i]], table[row[i+1]], table[row[i+2]]
+			if saturation != 1 {
+				l := luma(r, g, b)
+				r, g, b = l+(r-l)*saturation, l+(g-l)*saturation, l+(b-l)*saturation
+			}
+			switch {
+			case p.grayscale:
+				l := luma(r, g, b)
+				r, g, b = l, l, l
+			case p.sepia:
+				r, g, b = 0.393*r+0.769*g+0.189*b, 0.349*r+0.686*g+0.168*b, 0.272*r+0.534*g+0.131*b
+			}
+			row[i] = uint8(math.Round(clampChannel(r)))
+			row[i+1] = uint8(math.Round(clampChannel(g)))
+			row[i+2] = uint8(math.Round(clampChannel(b)))
+		}
+	}
+	return dst
+}
+
+// Luma by Rec. 601 as in JPEG.
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func clampChannel(v float64) float64 {
+	return math.Max(0, math.Min(255, v))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+)
+
+func adjustPixel(c color.NRGBA, p *adjustParams) color.Color {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, c)
+	return applyAdjustments(img, p).At(0, 0)
+}
+
+func TestApplyAdjustments_Golden(t *testing.T) {
+	for name, tc := range map[string]struct {
+		params   adjustParams
+		src, dst color.NRGBA
+	}{
+		"brightness":     {adjustParams{brightness: 10, gamma: 1}, color.NRGBA{100, 0, 250, 0xff}, color.NRGBA{126, 26, 255, 0xff}},
+		"darkness":       {adjustParams{brightness: -50, gamma: 1}, color.NRGBA{200, 100, 0, 0xff}, color.NRGBA{73, 0, 0, 0xff}},
+		"contrast":       {adjustParams{contrast: 50, gamma: 1}, color.NRGBA{200, 50, 128, 0xff}, color.NRGBA{236, 11, 128, 0xff}},
+		"flat":           {adjustParams{contrast: -100, gamma: 1}, color.NRGBA{200, 50, 0, 0xff}, color.NRGBA{128, 128, 128, 0xff}},
+		"gamma":          {adjustParams{gamma: 2}, color.NRGBA{64, 0, 255, 0xff}, color.NRGBA{128, 0, 255, 0xff}},
+		"desaturation":   {adjustParams{saturation: -100, gamma: 1}, color.NRGBA{200, 100, 50, 0xff}, color.NRGBA{124, 124, 124, 0xff}},
+		"saturation":     {adjustParams{saturation: 100, gamma: 1}, color.NRGBA{200, 100, 50, 0xff}, color.NRGBA{255, 76, 0, 0xff}},
+		"grayscale":      {adjustParams{grayscale: true, gamma: 1}, color.NRGBA{200, 100, 50, 0xff}, color.NRGBA{124, 124, 124, 0xff}},
+		"sepia":          {adjustParams{sepia: true, gamma: 1}, color.NRGBA{100, 100, 100, 0xff}, color.NRGBA{135, 120, 94, 0xff}},
+		"alpha":          {adjustParams{brightness: 10, gamma: 1}, color.NRGBA{100, 100, 100, 0x80}, color.NRGBA{126, 126, 126, 0x80}},
+		"brightnessGray": {adjustParams{brightness: 20, grayscale: true, gamma: 1}, color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{51, 51, 51, 0xff}},
+	} {
+		assert.Equal(t, tc.dst, adjustPixel(tc.src, &tc.params), name)
+	}
+}
+
+func TestParseAdjustments(t *testing.T) {
+	args, _ := url.ParseQuery("brightness=10&gamma=1.5&sepia=1")
+	p, err := parseAdjustments(args)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &adjustParams{brightness: 10, gamma: 1.5, sepia: true}, p)
+	assert.Equal(t, "10,0,0,1.5,false,true", p.String())
+	args, _ = url.ParseQuery("brightness=0&grayscale=0")
+	p, err = parseAdjustments(args)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestParseAdjustments_Errors(t *testing.T) {
+	for _, query := range []string{
+		"brightness=101",
+		"contrast=-101",
+		"saturation=lots",
+		"gamma=0",
+		"gamma=11",
+		"brightness=NaN",
+		"contrast=Inf",
+		"saturation=-Inf",
+		"gamma=nan",
+		"grayscale=yes",
+		"grayscale=1&sepia=1",
+	} {
+		args, _ := url.ParseQuery(query)
+		_, err := parseAdjustments(args)
+		assert.Error(t, err, query)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Printed instead of the secrets by `-print-config`.
+const hiddenSecret = "<hidden>"
+
+// Settings of the service. The defaults are overridden by the config
+// file given by `-config` flag, then by the environment variables
+// and then by the flags, see loadConfig(). The file is in TOML
+// format:
+//
+//	listen_at = "localhost:8080"
+//	cache_size = 314572800
+//	source_cache_size = 209715200
+//	source_caching_duration = "10m"
+//	failure_caching_duration = "1m"
+//	timeout_caching_duration = "10s"
+//	min_size = 32
+//	max_size = 8192
+//	jpeg_quality = 92
+//	resize_algorithm = "bilinear"
+//	caching_duration = "1h"
+//	fallback = "/etc/resizer/placeholder.jpg"
+//	presets_only = false
+//
+//	[presets]
+//	thumb = { width = 64, height = 64, mode = "fill" }
+//	card = { width = 300, mode = "fit", format = "jpeg", quality = 80 }
+//	"hero@2x" = { width = 2400, height = 800, mode = "fill", filter = "lanczos3" }
+//
+//	[watermarks.logo]
+//	path = "/etc/resizer/logo.png"
+//	position = "bottom-right"
+//	margin = 16
+//	opacity = 0.8
+//	scale = 0.2
+//
+//	[fonts]
+//	regular = "/usr/share/fonts/truetype/go/Go-Regular.ttf"
+//
+//	[origins.catalog]
+//	type = "http"
+//	base_url = "https://images.internal/catalog"
+//	allowed_paths = ["/products/"]
+//	timeout = "5s"
+//	max_size = 10485760
+//	headers = { Authorization = "Basic ..." }
+//	defaults = { width = 300, height = 0, mode = "fit", quality = 80 }
+//
+//	[origins.local]
+//	type = "local"
+//	root = "/mnt/images"
+//
+//	[origins.photos]
+//	type = "s3"
+//	endpoint = "http://localhost:9000"
+//	bucket = "photos"
+//	path_style = true
+//	access_key = "..."
+//	secret_key = "..."
+type config struct {
+	ListenAt   string `toml:"listen_at"`
+	AdminToken string `toml:"admin_token,omitempty"`
+	// Size of the cache of the results in bytes.
+	CacheSize int `toml:"cache_size"`
+	// Cache of the loaded sources, its size in bytes and how long the
+	// sources are fresh.
+	SourceCacheSize       int           `toml:"source_cache_size"`
+	SourceCachingDuration time.Duration `toml:"source_caching_duration"`
+	// How long the failed loads of the sources are remembered.
+	// Timeouts could be transient so they have own duration.
+	FailureCachingDuration time.Duration `toml:"failure_caching_duration"`
+	TimeoutCachingDuration time.Duration `toml:"timeout_caching_duration"`
+	// Limits and defaults of the transformations.
+	MinSize         uint64        `toml:"min_size"`
+	MaxSize         uint64        `toml:"max_size"`
+	JPEGQuality     int           `toml:"jpeg_quality"`
+	ResizeAlgorithm string        `toml:"resize_algorithm"`
+	CachingDuration time.Duration `toml:"caching_duration"`
+	// Image file or URL served when the source failed to load.
+	Fallback string                  `toml:"fallback,omitempty"`
+	Origins  map[string]originConfig `toml:"origins,omitempty"`
+	// Refuse the requests without preset.
+	PresetsOnly bool                         `toml:"presets_only"`
+	Presets     map[string]transformDefaults `toml:"presets,omitempty"`
+	// Overlays for `watermark` parameter.
+	Watermarks map[string]watermarkConfig `toml:"watermarks,omitempty"`
+	// TrueType fonts for `text` parameter by their names.
+	Fonts map[string]string `toml:"fonts,omitempty"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		ListenAt:               "localhost:8080",
+		CacheSize:              defaultCacheSize,
+		SourceCacheSize:        defaultSourceCacheSize,
+		SourceCachingDuration:  defaultSourceCachingDuration,
+		FailureCachingDuration: defaultFailureCachingDuration,
+		TimeoutCachingDuration: defaultTimeoutCachingDuration,
+		MinSize:                defaultMinSize,
+		MaxSize:                defaultMaxSize,
+		JPEGQuality:            defaultJPEGQuality,
+		ResizeAlgorithm:        defaultResizeAlgorithm,
+		CachingDuration:        defaultCachingDuration,
+	}
+}
+
+// Settings of the named origin. Which fields are used depends on the
+// type of the origin.
+type originConfig struct {
+	Type string `toml:"type"`
+	// For all the origins. Timeout is used by network origins only.
+	// Zero values mean the service defaults.
+	AllowedPaths []string          `toml:"allowed_paths,omitempty"`
+	Timeout      time.Duration     `toml:"timeout,omitempty"`
+	MaxSize      int64             `toml:"max_size,omitempty"`
+	Defaults     transformDefaults `toml:"defaults,omitempty"`
+	Fallback     string            `toml:"fallback,omitempty"`
+	// For `http` origins.
+	BaseURL string            `toml:"base_url,omitempty"`
+	Headers map[string]string `toml:"headers,omitempty"`
+	// For `local` origins.
+	Root string `toml:"root,omitempty"`
+	// For `s3` origins. Region is `us-east-1` by default.
+	Endpoint  string `toml:"endpoint,omitempty"`
+	Bucket    string `toml:"bucket,omitempty"`
+	Region    string `toml:"region,omitempty"`
+	AccessKey string `toml:"access_key,omitempty"`
+	SecretKey string `toml:"secret_key,omitempty"`
+	PathStyle bool   `toml:"path_style,omitempty"`
+}
+
+// Transform options used when the request omits them. Pointers
+// distinguish unset values from zeroes.
+type transformDefaults struct {
+	Width   *uint64 `toml:"width,omitempty"`
+	Height  *uint64 `toml:"height,omitempty"`
+	Mode    string  `toml:"mode,omitempty"`
+	Format  string  `toml:"format,omitempty"`
+	Quality *int    `toml:"quality,omitempty"`
+	Filter  string  `toml:"filter,omitempty"`
+}
+
+func (c originConfig) client() *http.Client {
+	if c.Timeout <= 0 {
+		return sourceClient
+	}
+	return &http.Client{Timeout: c.Timeout}
+}
+
+func (c originConfig) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return maxSourceSize
+	}
+	return c.MaxSize
+}
+
+// Option of the config which could be set by the flag and by the
+// environment variable besides the config file. The variable is
+// named after the flag: `-cache-size` is `RESIZER_CACHE_SIZE`.
+type option struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+func (c *config) options() []option {
+	return []option{
+		{"listen-at", "listen for HTTP requests at host:port", &c.ListenAt},
+		{"admin-token", "token for the admin API, the API is disabled when it is empty", &c.AdminToken},
+		{"cache-size", "size of the cache of the results in bytes", &c.CacheSize},
+		{"source-cache-size", "size of the cache of the sources in bytes", &c.SourceCacheSize},
+		{"source-caching-duration", "how long the loaded sources are fresh", &c.SourceCachingDuration},
+		{"failure-caching-duration", "how long the failed loads of the sources are remembered", &c.FailureCachingDuration},
+		{"timeout-caching-duration", "how long the timed out loads of the sources are remembered", &c.TimeoutCachingDuration},
+		{"min-size", "minimal width and height of the results", &c.MinSize},
+		{"max-size", "maximal width and height of the results", &c.MaxSize},
+		{"jpeg-quality", "default quality of JPEG results", &c.JPEGQuality},
+		{"resize-algorithm", "default filter of resizing", &c.ResizeAlgorithm},
+		{"caching-duration", "how long the results are fresh", &c.CachingDuration},
+		{"fallback", "image file or URL served when the source failed to load", &c.Fallback},
+		{"presets-only", "refuse the requests without preset", &c.PresetsOnly},
+	}
+}
+
+func envName(option string) string {
+	return "RESIZER_" + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// Sets the option from its text form as it is in the flags and in
+// the environment.
+func setOption(value interface{}, s string) error {
+	var err error
+	switch v := value.(type) {
+	case *string:
+		*v = s
+	case *int:
+		*v, err = strconv.Atoi(s)
+	case *uint64:
+		*v, err = strconv.ParseUint(s, 10, 64)
+	case *bool:
+		*v, err = strconv.ParseBool(s)
+	case *time.Duration:
+		*v, err = time.ParseDuration(s)
+	}
+	return err
+}
+
+// Flags for the options. They are set to the defaults and only the
+// flags given in the command line are copied to the config.
+type optionFlag struct {
+	value interface{}
+}
+
+func (f optionFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return fmt.Sprint(reflect.ValueOf(f.value).Elem())
+}
+
+func (f optionFlag) Set(s string) error {
+	return setOption(f.value, s)
+}
+
+func (f optionFlag) IsBoolFlag() bool {
+	_, ok := f.value.(*bool)
+	return ok
+}
+
+// Defines the flags for all the options.
+func defineFlags(flags *flag.FlagSet) {
+	for _, opt := range defaultConfig().options() {
+		flags.Var(optionFlag{opt.value}, opt.name, opt.usage)
+	}
+}
+
+// Makes the effective config: the defaults are overridden by the
+// config file, then by the environment and then by the flags.
+func loadConfig(path string, flags *flag.FlagSet) (*config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		// Mistyped keys would be silently ignored otherwise.
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return nil, fmt.Errorf("%s: unknown key %q", path, keys[0].String())
+		}
+	}
+	options := cfg.options()
+	for _, opt := range options {
+		if s, ok := os.LookupEnv(envName(opt.name)); ok {
+			if err := setOption(opt.value, s); err != nil {
+				return nil, fmt.Errorf("%s: %s", envName(opt.name), err)
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, opt := range options {
+			if opt.name == f.Name && err == nil {
+				err = setOption(opt.value, f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// Checks the settings which are not checked when they applied.
+func (c *config) validate() error {
+	switch {
+	case c.ListenAt == "":
+		return errors.New("`listen_at` is mandatory")
+	case c.CacheSize < 512*1024:
+		return errors.New("`cache_size` should be at least 524288 bytes")
+	case c.SourceCacheSize < 512*1024:
+		return errors.New("`source_cache_size` should be at least 524288 bytes")
+	case c.SourceCachingDuration < time.Second:
+		return errors.New("`source_caching_duration` should be at least 1s")
+	case c.FailureCachingDuration < time.Second:
+		return errors.New("`failure_caching_duration` should be at least 1s")
+	case c.TimeoutCachingDuration < time.Second:
+		return errors.New("`timeout_caching_duration` should be at least 1s")
+	case c.MinSize < 1:
+		return errors.New("`min_size` should be positive")
+	case c.MaxSize < c.MinSize:
+		return errors.New("`max_size` should not be less than `min_size`")
+	case c.JPEGQuality < 1 || c.JPEGQuality > 100:
+		return errors.New("`jpeg_quality` should be in range 1..100")
+	case !isFilter(c.ResizeAlgorithm):
+		return fmt.Errorf("`resize_algorithm` %q is unknown", c.ResizeAlgorithm)
+	case c.CachingDuration < time.Second:
+		return errors.New("`caching_duration` should be at least 1s")
+	}
+	return nil
+}
+
+// Prints the config in TOML format. Secrets are hidden so the output
+// could be shared: the tokens, the keys, the values of the headers
+// and the credentials in the URLs.
+func (c *config) print(w io.Writer) error {
+	printed := *c
+	if printed.AdminToken != "" {
+		printed.AdminToken = hiddenSecret
+	}
+	printed.Fallback = stripUserinfo(c.Fallback)
+	printed.Origins = make(map[string]originConfig, len(c.Origins))
+	for name, o := range c.Origins {
+		if o.SecretKey != "" {
+			o.SecretKey = hiddenSecret
+		}
+		if o.Headers != nil {
+			o.Headers = make(map[string]string, len(o.Headers))
+			for header := range c.Origins[name].Headers {
+				o.Headers[header] = hiddenSecret
+			}
+		}
+		o.Fallback = stripUserinfo(o.Fallback)
+		o.BaseURL = stripUserinfo(o.BaseURL)
+		o.Endpoint = stripUserinfo(o.Endpoint)
+		printed.Origins[name] = o
+	}
+	return toml.NewEncoder(w).Encode(printed)
+}
+
+// Removes the user and the password from the URL. Other strings are
+// returned as is.
+func stripUserinfo(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.User == nil {
+		return location
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Limit of Gaussian sigma for `blur` and `unsharp`. The kernel is
+// also not wider than the half of the smaller side of the result so
+// the cost per pixel is bounded by the size of the result.
+const maxSigma = 50.0
+
+// Unsharp mask: the difference with the blurred image multiplied by
+// amount is added to the channels differing from the blurred ones at
+// least by threshold.
+type unsharpParams struct {
+	sigma     float64
+	amount    float64
+	threshold int
+}
+
+const (
+	defaultUnsharpAmount = 1.0
+	maxUnsharpAmount     = 5.0
+)
+
+// Parses `blur` parameter, Gaussian sigma in pixels. Zero means no
+// blur.
+func parseBlur(args url.Values) (float64, error) {
+	if args.Get("blur") == "" {
+		return 0, nil
+	}
+	sigma, err := parseFloat(args.Get("blur"))
+	if err != nil || sigma < 0 || sigma > maxSigma {
+		return 0, fmt.Errorf("`blur` should be in range 0..%g", maxSigma)
+	}
+	return sigma, nil
+}
+
+// Parses `unsharp` parameter in form `radius[:amount[:threshold]]`.
+// Radius is Gaussian sigma in pixels, amount is 1 by default and
+// threshold in levels of the channels is 0.
+func parseUnsharp(args url.Values) (*unsharpParams, error) {
+	if args.Get("unsharp") == "" {
+		return nil, nil
+	}
+	parts := strings.Split(args.Get("unsharp"), ":")
+	if len(parts) > 3 {
+		return nil, errors.New("`unsharp` should be in form radius[:amount[:threshold]]")
+	}
+	p := &unsharpParams{amount: defaultUnsharpAmount}
+	var err error
+	if p.sigma, err = parseFloat(parts[0]); err != nil || p.sigma < 0 || p.sigma > maxSigma {
+		return nil, fmt.Errorf("radius of `unsharp` should be in range 0..%g", maxSigma)
+	}
+	if len(parts) > 1 {
+		if p.amount, err = parseFloat(parts[1]); err != nil || p.amount < 0 || p.amount > maxUnsharpAmount {
+			return nil, fmt.Errorf("amount of `unsharp` should be in range 0..%g", maxUnsharpAmount)
+		}
+	}
+	if len(parts) > 2 {
+		if p.threshold, err = strconv.Atoi(parts[2]); err != nil || p.threshold < 0 || p.threshold > 255 {
+			return nil, errors.New("threshold of `unsharp` should be in range 0..255")
+		}
+	}
+	if p.sigma == 0 || p.amount == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Part of the cache key.
+func (p *unsharpParams) String() string {
+	return fmt.Sprintf("%g:%g:%d", p.sigma, p.amount, p.threshold)
+}
+
+// Sharpens the image by unsharp mask. Alpha is kept and the colour
+// channels are limited by it as they are premultiplied.
+func unsharpMask(img image.Image, p *unsharpParams) image.Image {
+	src := toRGBA(img)
+	blurred := gaussianBlur(src, p.sigma)
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	width := 4 * bounds.Dx()
+	parallelRows(bounds.Dy(), func(y int) {
+		s := src.Pix[y*src.Stride : y*src.Stride+width]
+		b := blurred.Pix[y*blurred.Stride : y*blurred.Stride+width]
+		d := dst.Pix[y*dst.Stride : y*dst.Stride+width]
+		for i := 0; i < width; i += 4 {
+			alpha := s[i+3]
+			d[i+3] = alpha
+			for c := i; c < i+3; c++ {
+				v := float64(s[c])
+				if diff := v - float64(b[c]); math.Abs(diff) >= float64(p.threshold) {
+					v += p.amount * diff
+				}
+				d[c] = uint8(math.Round(math.Max(0, math.Min(float64(alpha), v))))
+			}
+		}
+	})
+	return dst
+}
+
+// Blurs the image by separable Gaussian convolution: by the rows and
+// then by the columns. Pixels are extended at the edges.
+func gaussianBlur(img image.Image, sigma float64) *image.RGBA {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	side := width
+	if height < side {
+		side = height
+	}
+	kernel := gaussianKernel(sigma, side/2)
+	radius := len(kernel) / 2
+
+	tmp := make([]float32, 4*width*height)
+	parallelRows(height, func(y int) {
+		row := src.Pix[y*src.Stride : y*src.Stride+4*width]
+		for x := 0; x < width; x++ {
+			var sum [4]float32
+			for k, weight := range kernel {
+				p := row[4*clampInt(x+k-radius, 0, width-1):]
+				sum[0] += weight * float32(p[0])
+				sum[1] += weight * float32(p[1])
+				sum[2] += weight * float32(p[2])
+				sum[3] += weight * float32(p[3])
+			}
+			copy(tmp[4*(y*width+x):], sum[:])
+		}
+	})
+	dst := image.NewRGBA(bounds)
+	parallelRows(height, func(y int) {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+4*width]
+		for x := 0; x < width; x++ {
+			var sum [4]float32
+			for k, weight := range kernel {
+				p := tmp[4*(clampInt(y+k-radius, 0, height-1)*width+x):]
+				sum[0] += weight * p[0]
+				sum[1] += weight * p[1]
+				sum[2] += weight * p[2]
+				sum[3] += weight * p[3]
+			}
+			for c, v := range sum {
+				row[4*x+c] = uint8(math.Min(255, float64(v)+0.5))
+			}
+		}
+	})
+	return dst
+}
+
+// Normalized Gaussian kernel of 2*radius+1 weights. Radius is three
+// sigmas but not more than maxRadius.
+func gaussianKernel(sigma float64, maxRadius int) []float32 {
+	radius := int(math.Ceil(3 * sigma))
+	if radius > maxRadius {
+		radius = maxRadius
+	}
+	if radius < 0 {
+		radius = 0
+	}
+	weights := make([]float64, 2*radius+1)
+	var total float64
+	for i := range weights {
+		x := float64(i - radius)
+		weights[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		total += weights[i]
+	}
+	kernel := make([]float32, len(weights))
+	for i, w := range weights {
+		kernel[i] = float32(w / total)
+	}
+	return kernel
+}
+
+// Calls fn for each row in range 0..n split between the processors.
+func parallelRows(n int, fn func(y int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			for y := from; y < to; y++ {
+				fn(y)
+			}
+		}(n*w/workers, n*(w+1)/workers)
+	}
+	wg.Wait()
+}
+
+// Returns the image in premultiplied RGBA, copied unless it is
+// already.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGaussianKernel(t *testing.T) {
+	kernel := gaussianKernel(1, 100)
+	var total float32
+	for _, w := range kernel {
+		total += w
+	}
+
+	assert.Len(t, kernel, 7)
+	assert.InDelta(t, 1, total, 1e-6)
+	assert.Equal(t, kernel[0], kernel[6])
+	assert.True(t, kernel[3] > kernel[2])
+	// Limited by the size of the image.
+	assert.Len(t, gaussianKernel(maxSigma, 5), 11)
+}
+
+func TestGaussianBlur_Solid(t *testing.T) {
+	img := gaussianBlur(newSolidImage(20, 10, color.RGBA{10, 200, 30, 0xff}), 3)
+
+	assert.Equal(t, color.RGBA{10, 200, 30, 0xff}, img.At(0, 0))
+	assert.Equal(t, color.RGBA{10, 200, 30, 0xff}, img.At(10, 5))
+}
+
+func TestGaussianBlur_Point(t *testing.T) {
+	src := newSolidImage(21, 21, color.Black)
+	src.Set(10, 10, color.White)
+	img := gaussianBlur(src, 1)
+
+	center := img.RGBAAt(10, 10).R
+	assert.True(t, center > 0 && center < 0xff)
+	assert.Equal(t, img.RGBAAt(9, 10), img.RGBAAt(11, 10))
+	assert.Equal(t, img.RGBAAt(10, 9), img.RGBAAt(10, 11))
+	assert.True(t, img.RGBAAt(9, 10).R > img.RGBAAt(8, 10).R)
+	assert.Equal(t, uint8(0), img.RGBAAt(0, 0).R)
+	assert.Equal(t, uint8(0xff), img.RGBAAt(0, 0).A)
+}
+
+// Left half is dark grey, right half is light grey.
+func newEdgeImage() *image.RGBA {
+	img := newSolidImage(20, 4, color.RGBA{60, 60, 60, 0xff})
+	for y := 0; y < 4; y++ {
+		for x := 10; x < 20; x++ {
+			img.Set(x, y, color.RGBA{180, 180, 180, 0xff})
+		}
+	}
+	return img
+}
+
+func TestUnsharpMask(t *testing.T) {
+	img := unsharpMask(newEdgeImage(), &unsharpParams{sigma: 1, amount: 1})
+
+	// Overshoot at both sides of the edge, flat areas are kept.
+	assert.True(t, img.At(10, 2).(color.RGBA).R > 180)
+	assert.True(t, img.At(9, 2).(color.RGBA).R < 60)
+	assert.Equal(t, color.RGBA{180, 180, 180, 0xff}, img.At(19, 2))
+	assert.Equal(t, color.RGBA{60, 60, 60, 0xff}, img.At(0, 2))
+}
+
+func TestUnsharpMask_Threshold(t *testing.T) {
+	img := unsharpMask(newEdgeImage(), &unsharpParams{sigma: 1, amount: 1, threshold: 255})
+
+	assert.Equal(t, color.RGBA{180, 180, 180, 0xff}, img.At(10, 2))
+	assert.Equal(t, color.RGBA{60, 60, 60, 0xff}, img.At(9, 2))
+}
+
+func TestParseUnsharp(t *testing.T) {
+	args, _ := url.ParseQuery("unsharp=1.5:0.5:3")
+	p, err := parseUnsharp(args)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &unsharpParams{sigma: 1.5, amount: 0.5, threshold: 3}, p)
+	assert.Equal(t, "1.5:0.5:3", p.String())
+	args, _ = url.ParseQuery("unsharp=2")
+	p, err = parseUnsharp(args)
+	assert.NoError(t, err)
+	assert.Equal(t, &unsharpParams{sigma: 2, amount: defaultUnsharpAmount}, p)
+	for _, query := range []string{"unsharp=51", "unsharp=1:6", "unsharp=1:1:256", "unsharp=1:1:1:1", "unsharp=a", "blur=-1", "blur=51",
+		"blur=NaN", "blur=Inf", "unsharp=NaN", "unsharp=1:NaN", "unsharp=1:Inf"} {
+		args, _ = url.ParseQuery(query)
+		_, err1 := parseUnsharp(args)
+		_, err2 := parseBlur(args)
+		assert.True(t, err1 != nil || err2 != nil, query)
+	}
+}
+
+func TestParallelRows(t *testing.T) {
+	var counts [100]int32
+	parallelRows(len(counts), func(y int) {
+		atomic.AddInt32(&counts[y], 1)
+	})
+
+	for y, n := range counts {
+		assert.Equal(t, int32(1), n, y)
+	}
+}
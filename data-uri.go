@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// Inline sources are passed in the query so the length is limited
+// by the size of request line the server accepts anyway.
+const maxDataURILength = 512 * 1024
+
+// Parses `data:` URI (RFC 2397) with the image inline. The source is
+// identified by hash of the content so the cache keys are short.
+func parseDataURI(uri string) (imageSource, error) {
+	if len(uri) > maxDataURILength {
+		return imageSource{}, errors.New("data URI is too long")
+	}
+	comma := strings.IndexByte(uri, ',')
+	if !strings.HasPrefix(uri, "data:") || comma < 0 {
+		return imageSource{}, errors.New("data URI should be in form `data:[<mediatype>][;base64],<data>`")
+	}
+	header, payload := uri[len("data:"):comma], uri[comma+1:]
+	isBase64 := strings.HasSuffix(header, ";base64")
+	header = strings.TrimSuffix(header, ";base64")
+	// Media type is mandatory here because the default one is
+	// text/plain.
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return imageSource{}, errors.New("data URI should have image media type")
+	}
+	var data []byte
+	if isBase64 {
+		// Unescaped `+` in the query turns into space.
+		payload = strings.Replace(payload, " ", "+", -1)
+		if data, err = base64.StdEncoding.DecodeString(payload); err != nil {
+			if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "=")); err != nil {
+				return imageSource{}, errors.New("data URI has broken base64 data")
+			}
+		}
+	} else {
+		var unescaped string
+		if unescaped, err = url.PathUnescape(payload); err != nil {
+			return imageSource{}, errors.New("data URI has broken escaped data")
+		}
+		data = []byte(unescaped)
+	}
+	if len(data) == 0 {
+		return imageSource{}, errors.New("data URI is empty")
+	}
+	sum := sha256.Sum256(data)
+	return imageSource{path: "data:sha256:" + hex.EncodeToString(sum[:]), data: data}, nil
+}
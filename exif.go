@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// EXIF orientation of the image which is shown as is.
+const normalOrientation = 1
+
+// Finds EXIF orientation in JPEG data. Only the markers before the
+// image data are looked through so the image is not decoded. Returns
+// normal orientation when there is no EXIF or it is broken.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return normalOrientation
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return normalOrientation
+		}
+		marker := data[i+1]
+		// Start of scan or end of image, no metadata after them.
+		if marker == 0xda || marker == 0xd9 {
+			return normalOrientation
+		}
+		// Fill bytes before the marker.
+		if marker == 0xff {
+			i++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return normalOrientation
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return normalOrientation
+}
+
+// Reads the orientation tag from the first IFD of TIFF structure
+// inside EXIF segment.
+func tiffOrientation(tiff []byte) int {
+	const orientationTag = 0x0112
+	if len(tiff) < 8 {
+		return normalOrientation
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return normalOrientation
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return normalOrientation
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != orientationTag {
+			continue
+		}
+		if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+			return value
+		}
+		break
+	}
+	return normalOrientation
+}
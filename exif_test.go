@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// Makes JPEG with EXIF segment containing only the orientation tag.
+func makeOrientedJPEG(t *testing.T, order binary.ByteOrder, orientation uint16) []byte {
+	tiff := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+	binary.Write(tiff, order, uint16(1))
+	binary.Write(tiff, order, []uint16{0x0112, 3})
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, []uint16{orientation, 0})
+	binary.Write(tiff, order, uint32(0))
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	img := new(bytes.Buffer)
+	if err := jpeg.Encode(img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{0xff, 0xd8, 0xff, 0xe1}
+	data = append(data, byte((len(segment)+2)>>8), byte(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, img.Bytes()[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	little := makeOrientedJPEG(t, binary.LittleEndian, 6)
+	big := makeOrientedJPEG(t, binary.BigEndian, 8)
+	info, err := inspectImage(little)
+
+	assert.Equal(t, 6, jpegOrientation(little))
+	assert.Equal(t, 8, jpegOrientation(big))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, info.Orientation)
+	assert.Equal(t, "gray", info.ColorModel)
+}
+
+func TestJPEGOrientation_Broken(t *testing.T) {
+	data := makeOrientedJPEG(t, binary.LittleEndian, 6)
+
+	assert.Equal(t, 1, jpegOrientation(data[:20]))
+	assert.Equal(t, 1, jpegOrientation([]byte("not a jpeg")))
+	assert.Equal(t, 1, jpegOrientation(makeOrientedJPEG(t, binary.BigEndian, 42)))
+}
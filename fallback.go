@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failures of the sources by their classes, shown by admin API at
+// /admin/metrics.
+var sourceFailures = struct {
+	sync.Mutex
+	classes map[string]int64
+}{classes: make(map[string]int64)}
+
+// Placeholder served instead of the source which failed to load. It
+// could be set globally and for each origin. Files are decoded once
+// at startup, URLs are loaded as any other source.
+type fallbackImage struct {
+	url string
+	img image.Image
+}
+
+func newFallback(location string) (*fallbackImage, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &fallbackImage{url: location}, nil
+	}
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackImage{img: img}, nil
+}
+
+func (f *fallbackImage) load() (image.Image, error) {
+	if f.img != nil {
+		return f.img, nil
+	}
+	return loadURL(imageSource{path: f.url})
+}
+
+// Logs and counts the failure of the source.
+func reportSourceFailure(src imageSource, err error) {
+	class := "other"
+	if srcErr, ok := err.(*sourceError); ok {
+		class = srcErr.class.String()
+	}
+	sourceFailures.Lock()
+	sourceFailures.classes[class]++
+	sourceFailures.Unlock()
+	log.Printf("source %s failed: %s", src, err)
+}
+
+// Copy of the failure counters.
+func sourceFailureCounts() map[string]int64 {
+	sourceFailures.Lock()
+	defer sourceFailures.Unlock()
+	counts := make(map[string]int64, len(sourceFailures.classes))
+	for class, n := range sourceFailures.classes {
+		counts[class] = n
+	}
+	return counts
+}
+
+// Writes the fallback resized as requested instead of the failed
+// source. Clients should not keep it for long and there is no Etag
+// for it so the real image is shown as soon as it is available. The
+// fallback is not stored in the cache for the same reason. Returns
+// false when there is no fallback for the source.
+func serveFallback(w http.ResponseWriter, params *resizeParams) bool {
+	src, s := params.source, currentSettings()
+	fallback := s.fallback
+	if o, ok := s.origins[src.origin]; ok && o.fallback != nil {
+		fallback = o.fallback
+	}
+	if fallback == nil {
+		return false
+	}
+	img, err := fallback.load()
+	if err != nil {
+		log.Printf("fallback for %s failed: %s", src, err)
+		return false
+	}
+	data, err := processImage(img, params)
+	if err != nil {
+		log.Printf("fallback for %s failed: %s", src, err)
+		return false
+	}
+	w.Header().Del("Etag")
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(fallbackCachingDuration/time.Second)))
+	w.Header().Set("X-Fallback", "1")
+	w.Write(data)
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Listing of the whole cache could be huge so the number of returned
+// entries limited by default.
+const defaultAdminListLimit = 1000
+
+// Cache entry as it listed by admin API.
+type adminCacheEntry struct {
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+	TTL  uint32 `json:"ttl"`
+}
+
+// Cache statistics as it shown by admin API.
+type adminCacheStats struct {
+	Entries        int64   `json:"entries"`
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRate        float64 `json:"hit_rate"`
+	Evacuated      int64   `json:"evacuated"`
+	Expired        int64   `json:"expired"`
+	Overwritten    int64   `json:"overwritten"`
+	AvgAccessTime  int64   `json:"avg_access_time"`
+	SourceEntries  int     `json:"source_entries"`
+	SourceSizeUsed int     `json:"source_size_used"`
+}
+
+// Failure counters as they shown by admin API.
+type adminMetrics struct {
+	SourceFailures  map[string]int64  `json:"source_failures"`
+	CircuitBreakers map[string]string `json:"circuit_breakers"`
+}
+
+// Implements handler for `/admin/cache`:
+//
+//	GET    /admin/cache?prefix=...&limit=N  lists the results with their TTLs
+//	DELETE /admin/cache?key=...             deletes the single result
+//	DELETE /admin/cache?url=...             deletes all the results for the source URL in the background
+//	DELETE /admin/cache?all=1               clears the whole cache
+func handleAdminCacheRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	args := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		limit := defaultAdminListLimit
+		if args.Get("limit") != "" {
+			var err error
+			if limit, err = strconv.Atoi(args.Get("limit")); err != nil || limit <= 0 {
+				http.Error(w, "400 request error: `limit` should be positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, listCacheEntries(args.Get("prefix"), limit))
+	case "DELETE":
+		switch {
+		case args.Get("key") != "":
+			if !cache.Del([]byte(args.Get("key"))) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		case args.Get("url") != "":
+			sources.del(args.Get("url"))
+			failures.Del([]byte(args.Get("url")))
+			// The results are looked up by the scan of the
+			// whole cache, it runs in the background.
+			go deleteResults(args.Get("url"))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case args.Get("all") != "":
+			if all, err := strconv.ParseBool(args.Get("all")); err != nil || !all {
+				http.Error(w, "400 request error: `all` should be 1", http.StatusBadRequest)
+				return
+			}
+			cache.Clear()
+		default:
+			http.Error(w, "400 request error: one of `key`, `url` or `all=1` is required", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Implements handler for `/admin/stats`: GET shows the cache
+// statistics and DELETE resets them.
+func handleAdminStatsRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		entries, size := sources.stats()
+		writeJSON(w, adminCacheStats{
+			Entries:        cache.EntryCount(),
+			Hits:           cache.HitCount(),
+			Misses:         cache.MissCount(),
+			HitRate:        cache.HitRate(),
+			Evacuated:      cache.EvacuateCount(),
+			Expired:        cache.ExpiredCount(),
+			Overwritten:    cache.OverwriteCount(),
+			AvgAccessTime:  cache.AverageAccessTime(),
+			SourceEntries:  entries,
+			SourceSizeUsed: size,
+		})
+	case "DELETE":
+		cache.ResetStatistics()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Implements handler for `/admin/metrics`: GET shows the counters
+// of the failed sources by their classes and the states of the
+// circuit breakers by hosts.
+func handleAdminMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, adminMetrics{
+		SourceFailures:  sourceFailureCounts(),
+		CircuitBreakers: breakerStates(),
+	})
+}
+
+// Admin API is disabled until the token is set. The token compared
+// in constant time for not giving hints about it.
+func checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func listCacheEntries(prefix string, limit int) []adminCacheEntry {
+	entries := make([]adminCacheEntry, 0)
+	iter := cache.NewIterator()
+	for entry := iter.Next(); entry != nil && len(entries) < limit; entry = iter.Next() {
+		if !strings.HasPrefix(string(entry.Key), prefix) {
+			continue
+		}
+		// The entry could expire or be evicted since iterator got it.
+		ttl, err := cache.TTL(entry.Key)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, adminCacheEntry{Key: string(entry.Key), Size: len(entry.Value), TTL: ttl})
+	}
+	return entries
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/url"
+)
+
+// Image metadata as it shown by `/info`.
+type imageInfo struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Format      string `json:"format"`
+	Size        int    `json:"size"`
+	ColorModel  string `json:"color_model"`
+	Orientation int    `json:"orientation"`
+	HasAlpha    bool   `json:"has_alpha"`
+}
+
+// Implements handler for `/info`. The source is set the same way as
+// for `/resize` and loaded through the same caches.
+func handleInfoRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	args, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	src, _, err := currentSettings().sourceFromArgs(args)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	info, err := loadInfo(src)
+	if err != nil {
+		reportSourceFailure(src, err)
+		http.Error(w, fmt.Sprintf("426 image loading error: %s", err), http.StatusFailedDependency)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// Loads the source and inspects it. The failures are cached the same
+// way as in loadURL().
+func loadInfo(src imageSource) (*imageInfo, error) {
+	if err := cachedFailure(src.String()); err != nil {
+		return nil, err
+	}
+	entry, err := fetchSource(src)
+	if err == nil {
+		var info *imageInfo
+		if info, err = inspectImage(entry.data); err == nil {
+			return info, nil
+		}
+		if err != errSourceTooLarge {
+			err = &sourceError{class: failureNotImage, msg: err.Error()}
+		}
+	}
+	rememberFailure(src.String(), err)
+	return nil, err
+}
+
+// Reads the metadata from the headers of the image without decoding
+// the pixels. Only GIF is decoded for the transparency as it is set
+// by the frames and not by the header.
+func inspectImage(data []byte) (*imageInfo, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	info := &imageInfo{
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Format:      format,
+		Size:        len(data),
+		ColorModel:  colorModelName(cfg.ColorModel),
+		Orientation: normalOrientation,
+		HasAlpha:    hasAlpha(cfg.ColorModel),
+	}
+	switch format {
+	case "jpeg":
+		info.Orientation = jpegOrientation(data)
+	case "png":
+		// Decoder of the config stops before tRNS chunk so the
+		// transparency of RGB, gray and paletted images is not in
+		// the colour model.
+		info.HasAlpha = info.HasAlpha || pngHasTransparency(data)
+	case "gif":
+		if err = checkPixels(cfg); err != nil {
+			return nil, err
+		}
+		img, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if paletted, ok := img.(*image.Paletted); ok {
+			info.HasAlpha = hasAlpha(paletted.Palette)
+		}
+	}
+	return info, nil
+}
+
+// Looks for tRNS chunk before the pixel data. PNG starts with 8 bytes
+// of the signature followed by the chunks: length, type, data and CRC.
+func pngHasTransparency(data []byte) bool {
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		switch string(data[pos+4 : pos+8]) {
+		case "tRNS":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		if length > len(data) {
+			return false
+		}
+		pos += 12 + length
+	}
+	return false
+}
+
+func colorModelName(model color.Model) string {
+	// Palettes are slices and could not be compared with the models.
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+	switch model {
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel:
+		return "alpha"
+	case color.Alpha16Model:
+		return "alpha16"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.NYCbCrAModel:
+		return "nycbcra"
+	case color.CMYKModel:
+		return "cmyk"
+	}
+	return "unknown"
+}
+
+// Decoders use RGBA models for the images without transparency and
+// the non-premultiplied ones for the images with it.
+func hasAlpha(model color.Model) bool {
+	if palette, ok := model.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+	switch model {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// Encodes the image to PNG with the chunk inserted after IHDR.
+func encodePNGWithChunk(t *testing.T, img image.Image, kind string, chunk []byte) []byte {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Signature and IHDR of 13 bytes with its length, type and CRC.
+	ihdrEnd := 8 + 12 + 13
+	out := bytes.NewBuffer(append([]byte(nil), data[:ihdrEnd]...))
+	binary.Write(out, binary.BigEndian, uint32(len(chunk)))
+	typed := append([]byte(kind), chunk...)
+	out.Write(typed)
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(typed))
+	out.Write(data[ihdrEnd:])
+	return out.Bytes()
+}
+
+func TestInspectImage_PNGTransparency(t *testing.T) {
+	rgb := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range rgb.Pix {
+		rgb.Pix[i] = 0xff
+	}
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	paletted := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.NRGBA{0, 0, 0, 0}, color.NRGBA{0xff, 0, 0, 0xff}})
+	for name, data := range map[string][]byte{
+		"rgb":      encodePNGWithChunk(t, rgb, "tRNS", []byte{0, 0xff, 0, 0xff, 0, 0xff}),
+		"gray":     encodePNGWithChunk(t, gray, "tRNS", []byte{0, 0}),
+		"paletted": encodePNGWithChunk(t, paletted, "tEXt", []byte("Comment\x00test")),
+	} {
+		info, err := inspectImage(data)
+
+		assert.NoError(t, err, name)
+		assert.True(t, info.HasAlpha, name)
+	}
+	opaque := encodePNGWithChunk(t, rgb, "tEXt", []byte("Comment\x00tRNS"))
+	info, err := inspectImage(opaque)
+
+	assert.NoError(t, err)
+	assert.False(t, info.HasAlpha)
+}
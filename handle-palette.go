@@ -0,0 +1,208 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Limits of the palette extraction that could be moved to the config.
+const (
+	defaultPaletteSize = 5
+	maxPaletteSize     = 16
+	// The colours are taken from the copy downscaled to this size,
+	// it is enough for dominant colours and keeps the work small.
+	paletteSampleSize = 64
+	// Pixels more transparent than this are not counted.
+	paletteMinAlpha = 0x8000
+)
+
+// Colour of the palette as it shown by `/palette`.
+type paletteColor struct {
+	Color      string  `json:"color"`
+	Percentage float64 `json:"percentage"`
+}
+
+// Implements handler for `/palette`. Returns `n` dominant colours of
+// the source with their shares in percents as JSON.
+func handlePaletteRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	src, n, err := parsePaletteArgs(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	key := []byte(src.String() + ":palette:" + strconv.Itoa(n))
+	if useServerCache(w, key, func() ([]byte, error) { return renderPalette(src, n) }) {
+		return
+	}
+	data, err := renderPalette(src, n)
+	if err != nil {
+		reportSourceFailure(src, err)
+		w.Header().Del("Content-Type")
+		http.Error(w, fmt.Sprintf("426 image loading error: %s", err), http.StatusFailedDependency)
+		return
+	}
+	w.Write(data)
+	storeResult(key, data)
+}
+
+func parsePaletteArgs(r *http.Request) (src imageSource, n int, err error) {
+	args, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return
+	}
+	if src, _, err = currentSettings().sourceFromArgs(args); err != nil {
+		return
+	}
+	n = defaultPaletteSize
+	if args.Get("n") != "" {
+		if n, err = strconv.Atoi(args.Get("n")); err != nil || n < 1 || n > maxPaletteSize {
+			err = fmt.Errorf("`n` should be in range 1..%d", maxPaletteSize)
+		}
+	}
+	return
+}
+
+func renderPalette(src imageSource, n int) ([]byte, error) {
+	img, err := loadURL(src)
+	if err != nil {
+		return nil, err
+	}
+	palette, err := extractPalette(img, n)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(palette)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Finds the dominant colours with median cut on the downscaled copy
+// of the image. Fewer colours are returned when the image has less.
+func extractPalette(img image.Image, n int) ([]paletteColor, error) {
+	var pixels []colorBoxPixel
+	sample := downscale(img, paletteSampleSize)
+	bounds := sample.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := sample.At(x, y).RGBA()
+			if a < paletteMinAlpha {
+				continue
+			}
+			// Colours are not premultiplied in the palette.
+			pixels = append(pixels, colorBoxPixel{
+				uint8(r * 0xffff / a >> 8), uint8(g * 0xffff / a >> 8), uint8(b * 0xffff / a >> 8),
+			})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil, errors.New("image is fully transparent")
+	}
+	boxes := medianCut(pixels, n)
+	palette := make([]paletteColor, len(boxes))
+	for i, box := range boxes {
+		r, g, b := box.average()
+		palette[i] = paletteColor{
+			Color:      fmt.Sprintf("#%02x%02x%02x", r, g, b),
+			Percentage: float64(len(box)) * 100 / float64(len(pixels)),
+		}
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Percentage > palette[j].Percentage })
+	return palette, nil
+}
+
+// Shrinks the image so its larger side is not over the size keeping
+// the aspect ratio. Small images are left as is.
+func downscale(img image.Image, size uint) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= int(size) && bounds.Dy() <= int(size) {
+		return img
+	}
+	if bounds.Dx() >= bounds.Dy() {
+		return resize.Resize(size, 0, img, resize.Bilinear)
+	}
+	return resize.Resize(0, size, img, resize.Bilinear)
+}
+
+type colorBoxPixel [3]uint8
+
+// Pixels of the colour space region in median cut.
+type colorBox []colorBoxPixel
+
+// Returns the channel with the widest range of values and the range.
+func (b colorBox) widest() (channel int, width int) {
+	for c := 0; c < 3; c++ {
+		min, max := 255, 0
+		for _, p := range b {
+			if int(p[c]) < min {
+				min = int(p[c])
+			}
+			if int(p[c]) > max {
+				max = int(p[c])
+			}
+		}
+		if max-min > width {
+			channel, width = c, max-min
+		}
+	}
+	return channel, width
+}
+
+func (b colorBox) average() (r, g, bl uint8) {
+	var sum [3]int
+	for _, p := range b {
+		for c := 0; c < 3; c++ {
+			sum[c] += int(p[c])
+		}
+	}
+	return uint8(sum[0] / len(b)), uint8(sum[1] / len(b)), uint8(sum[2] / len(b))
+}
+
+// Splits the pixels into up to `n` boxes. The box with the largest
+// spread weighted by its population is split by the median of its
+// widest channel each time.
+func medianCut(pixels []colorBoxPixel, n int) []colorBox {
+	boxes := []colorBox{pixels}
+	for len(boxes) < n {
+		best, bestScore := -1, 0
+		for i, box := range boxes {
+			if _, width := box.widest(); width > 0 && width*len(box) > bestScore {
+				best, bestScore = i, width*len(box)
+			}
+		}
+		// All the boxes have single colour.
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		channel, _ := box.widest()
+		sort.Slice(box, func(i, j int) bool { return box[i][channel] < box[j][channel] })
+		// Equal values stay in the same box so the split is moved
+		// from the median to the nearest change of the value.
+		split := len(box) / 2
+		for split < len(box) && box[split][channel] == box[split-1][channel] {
+			split++
+		}
+		if split == len(box) {
+			for split = len(box) / 2; box[split][channel] == box[split-1][channel]; split-- {
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+	return boxes
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestExtractPalette_TwoColors(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 60, 60))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0xff, 0, 0, 0xff}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 60, 15), &image.Uniform{color.RGBA{0, 0, 0xff, 0xff}}, image.Point{}, draw.Src)
+	palette, err := extractPalette(img, 5)
+
+	assert.NoError(t, err)
+	if assert.Len(t, palette, 2) {
+		assert.Equal(t, "#ff0000", palette[0].Color)
+		assert.InDelta(t, 75, palette[0].Percentage, 1)
+		assert.Equal(t, "#0000ff", palette[1].Color)
+		assert.InDelta(t, 25, palette[1].Percentage, 1)
+	}
+}
+
+func TestExtractPalette_SkipsTransparent(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	img.Set(0, 0, color.NRGBA{0, 0x80, 0, 0xff})
+	palette, err := extractPalette(img, 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []paletteColor{{Color: "#008000", Percentage: 100}}, palette)
+}
+
+func TestExtractPalette_FullyTransparent(t *testing.T) {
+	_, err := extractPalette(image.NewNRGBA(image.Rect(0, 0, 10, 10)), 3)
+
+	assert.Error(t, err)
+}
+
+func TestMedianCut_Limit(t *testing.T) {
+	var pixels []colorBoxPixel
+	for i := 0; i < 256; i++ {
+		pixels = append(pixels, colorBoxPixel{uint8(i), uint8(255 - i), 0})
+	}
+	boxes := medianCut(pixels, 4)
+	total := 0
+	for _, box := range boxes {
+		total += len(box)
+	}
+
+	assert.Len(t, boxes, 4)
+	assert.Equal(t, 256, total)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const pathPrefix = "/r/"
+
+// Parameters of `/resize` which have no compact tokens in the path
+// form and are set as `name=value`. The values are URL-escaped. These
+// are the effects, see effectArgs.
+var pathParams = make(map[string]bool)
+
+func init() {
+	for _, arg := range effectArgs {
+		pathParams[arg] = true
+	}
+}
+
+// Implements handler for `/r/{options}/{source}`. The same as
+// `/resize` but without query so CDNs cache it as usual static file.
+// Options are comma separated tokens in any order:
+//
+//	300x200, 300x, x200     width and height, omitted side is zero
+//	stretch, fit, fill      mode of resizing
+//	q80                     quality of JPEG
+//	jpeg, jpg, png, gif     format of the result
+//	nearest, bilinear, ...  filter of resizing
+//	card, hero@2x, ...      preset by its name
+//	name=value              other parameters, see pathParams
+//
+// The source is the URL-escaped or base64url-encoded URL or
+// `origin:path` of the configured origin.
+func handlePathRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	args, err := parsePath(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	params, err := parseArgs(args, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	serveResize(w, r, params, fmt.Sprintf("public, max-age=%d", int(currentSettings().config.CachingDuration.Seconds())))
+}
+
+// Converts the path to the arguments as they are in the query of
+// `/resize` request so both forms are parsed the same way.
+func parsePath(path string) (url.Values, error) {
+	s := currentSettings()
+	path = strings.TrimPrefix(path, pathPrefix)
+	slash := strings.IndexByte(path, '/')
+	if slash < 0 {
+		return nil, errors.New("path should be in form /r/{options}/{source}")
+	}
+	args := make(url.Values)
+	for _, token := range strings.Split(path[:slash], ",") {
+		name, value, err := parseOptionToken(token)
+		if _, ok := s.presets[token]; ok {
+			name, value, err = "preset", token, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if name == "size" {
+			i := strings.IndexByte(value, 'x')
+			width, height := value[:i], value[i+1:]
+			if width == "" {
+				width = "0"
+			}
+			if height == "" {
+				height = "0"
+			}
+			if args.Get("width") != "" {
+				return nil, fmt.Errorf("option %q is duplicated", token)
+			}
+			args.Set("width", width)
+			args.Set("height", height)
+			continue
+		}
+		if args.Get(name) != "" {
+			return nil, fmt.Errorf("option %q is duplicated", token)
+		}
+		args.Set(name, value)
+	}
+	source, err := parsePathSource(path[slash+1:])
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.IndexByte(source, ':'); i > 0 {
+		if _, ok := s.origins[source[:i]]; ok {
+			args.Set("src", source)
+			return args, nil
+		}
+	}
+	args.Set("url", source)
+	return args, nil
+}
+
+// Tells the kind of the option by its token.
+func parseOptionToken(token string) (name, value string, err error) {
+	switch {
+	case token == "":
+		return "", "", errors.New("empty option")
+	case resizeModes[token]:
+		return "mode", token, nil
+	case outputFormats[token] || token == "jpg" || token == "webp":
+		return "format", token, nil
+	case isFilter(token):
+		return "filter", token, nil
+	case token[0] == 'q' && isDigits(token[1:]):
+		return "quality", token[1:], nil
+	}
+	if i := strings.IndexByte(token, '='); i > 0 && pathParams[token[:i]] {
+		value, err := url.PathUnescape(token[i+1:])
+		return token[:i], value, err
+	}
+	if i := strings.IndexByte(token, 'x'); i >= 0 && isDigits(token[:i]+token[i+1:]) {
+		return "size", token, nil
+	}
+	return "", "", fmt.Errorf("unknown option %q", token)
+}
+
+func isFilter(token string) bool {
+	_, ok := resizeFilters[token]
+	return ok
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Sources with scheme or origin name are URL-escaped, the rest are
+// base64url-encoded with or without padding.
+func parsePathSource(value string) (string, error) {
+	source, err := url.PathUnescape(value)
+	if err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", errors.New("source is empty")
+	}
+	if strings.Contains(source, ":") {
+		// ServeMux cleans `//` in the paths and redirects so the
+		// scheme of the URL could come with single slash.
+		for _, scheme := range []string{"http:/", "https:/"} {
+			if strings.HasPrefix(source, scheme) && !strings.HasPrefix(source, scheme+"/") {
+				source = scheme + source[len(scheme)-1:]
+			}
+		}
+		return source, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(source, "="))
+	if err != nil {
+		return "", errors.New("source should be URL-escaped or base64url-encoded")
+	}
+	return string(data), nil
+}
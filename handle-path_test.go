@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"image"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Makes the path form of the request for the parameters. Sources
+// are base64url-encoded as they could contain anything.
+func formatPath(params *resizeParams) string {
+	var size string
+	if params.width > 0 {
+		size = strconv.FormatUint(params.width, 10)
+	}
+	size += "x"
+	if params.height > 0 {
+		size += strconv.FormatUint(params.height, 10)
+	}
+	options := []string{size, params.mode, params.format, "q" + strconv.Itoa(params.quality), params.filter}
+	return pathPrefix + strings.Join(options, ",") + "/" +
+		base64.RawURLEncoding.EncodeToString([]byte(params.source.String()))
+}
+
+func TestParsePath_RoundTrip(t *testing.T) {
+	for _, params := range []*resizeParams{
+		{source: imageSource{path: goodImageURL}, width: 300, height: 200, mode: "fit", format: "png", quality: 80, filter: "lanczos3"},
+		{source: imageSource{origin: "local", path: "l_hires.jpg"}, width: 0, height: defaultMinSize, mode: "fill", format: "jpeg", quality: 1, filter: "nearest"},
+		{source: imageSource{path: goodImageURL + "?a=b&c=%2F"}, width: defaultMaxSize, height: 0, mode: "stretch", format: "gif", quality: 100, filter: "bicubic"},
+	} {
+		args, err := parsePath(formatPath(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parseArgs(args, false)
+
+		assert.NoError(t, err)
+		assert.Equal(t, params, parsed)
+	}
+}
+
+func TestParsePath_SameAsQuery(t *testing.T) {
+	query, err := url.ParseQuery("url=" + url.QueryEscape(goodImageURL) + "&width=300&height=0&mode=fit&quality=80&format=png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromQuery, err := parseArgs(query, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := parsePath("/r/png,q80,300x,fit/" + url.PathEscape(goodImageURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPath, err := parseArgs(path, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fromQuery, fromPath)
+}
+
+func TestParsePath_OriginSource(t *testing.T) {
+	args, err := parsePath("/r/x64/local:l_hires.jpg")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "local:l_hires.jpg", args.Get("src"))
+	assert.Equal(t, "0", args.Get("width"))
+	assert.Equal(t, "64", args.Get("height"))
+}
+
+func TestParsePath_Errors(t *testing.T) {
+	for _, path := range []string{
+		"/r/300x200",
+		"/r/300x200/",
+		"/r/300x200,fit,fill/" + url.PathEscape(goodImageURL),
+		"/r/300x200,,fit/" + url.PathEscape(goodImageURL),
+		"/r/300x200,q8o/" + url.PathEscape(goodImageURL),
+		"/r/300x200,huge/" + url.PathEscape(goodImageURL),
+		"/r/300x200/not+base64",
+	} {
+		_, err := parsePath(path)
+
+		assert.Error(t, err, path)
+	}
+}
+
+func TestTransformImage_Modes(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	params := &resizeParams{width: 100, height: 100, filter: "bilinear"}
+	for mode, size := range map[string]image.Point{
+		"stretch": {100, 100},
+		"fit":     {100, 50},
+		"fill":    {100, 100},
+	} {
+		params.mode = mode
+
+		assert.Equal(t, size, transformImage(src, params).Bounds().Size(), mode)
+	}
+}
+
+func TestParsePath_CleanedScheme(t *testing.T) {
+	args, err := parsePath("/r/64x/http:/localhost:8080/static/l_hires.jpg")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/static/l_hires.jpg", args.Get("url"))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Size of the image for DCT in pHash. Only 8x8 lowest frequencies of
+// it are used for the hash.
+const phashSampleSize = 32
+
+// Perceptual hashes of the image as they shown by `/phash`.
+type imageHashes struct {
+	AHash string `json:"ahash"`
+	DHash string `json:"dhash"`
+	PHash string `json:"phash"`
+
+	ahash, dhash, phash uint64
+}
+
+// Hamming distances between the hashes as they shown by `/compare`.
+type hashDistances struct {
+	AHash int `json:"ahash"`
+	DHash int `json:"dhash"`
+	PHash int `json:"phash"`
+}
+
+// Implements handler for `/phash`. The source is set the same way as
+// for `/resize`.
+func handlePHashRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	args, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	src, _, err := currentSettings().sourceFromArgs(args)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	hashes, err := loadHashes(src)
+	if err != nil {
+		reportSourceFailure(src, err)
+		http.Error(w, fmt.Sprintf("426 image loading error: %s", err), http.StatusFailedDependency)
+		return
+	}
+	writeJSON(w, hashes)
+}
+
+// Implements handler for `/compare`. Two sources are set by `url1`
+// and `url2` or by `src1` and `src2` for the origins.
+func handleCompareRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	args, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
+		return
+	}
+	var hashes [2]*imageHashes
+	for i, n := range []string{"1", "2"} {
+		sourceArgs := url.Values{"url": {args.Get("url" + n)}, "src": {args.Get("src" + n)}}
+		src, _, err := currentSettings().sourceFromArgs(sourceArgs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 request error: source %s: %s", n, err), http.StatusBadRequest)
+			return
+		}
+		if hashes[i], err = loadHashes(src); err != nil {
+			reportSourceFailure(src, err)
+			http.Error(w, fmt.Sprintf("426 image loading error: source %s: %s", n, err), http.StatusFailedDependency)
+			return
+		}
+	}
+	writeJSON(w, hashDistances{
+		AHash: bits.OnesCount64(hashes[0].ahash ^ hashes[1].ahash),
+		DHash: bits.OnesCount64(hashes[0].dhash ^ hashes[1].dhash),
+		PHash: bits.OnesCount64(hashes[0].phash ^ hashes[1].phash),
+	})
+}
+
+func loadHashes(src imageSource) (*imageHashes, error) {
+	img, err := loadURL(src)
+	if err != nil {
+		return nil, err
+	}
+	hashes := &imageHashes{ahash: averageHash(img), dhash: differenceHash(img), phash: perceptualHash(img)}
+	hashes.AHash = fmt.Sprintf("%016x", hashes.ahash)
+	hashes.DHash = fmt.Sprintf("%016x", hashes.dhash)
+	hashes.PHash = fmt.Sprintf("%016x", hashes.phash)
+	return hashes, nil
+}
+
+// Bits are set for the pixels of 8x8 copy brighter than the average.
+func averageHash(img image.Image) uint64 {
+	pixels := grayPixels(img, 8, 8)
+	var sum float64
+	for _, p := range pixels {
+		sum += p
+	}
+	return hashAbove(pixels, sum/float64(len(pixels)))
+}
+
+// Bits are set where the brightness grows from left to right in 9x8
+// copy.
+func differenceHash(img image.Image) uint64 {
+	pixels := grayPixels(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Bits are set for 8x8 lowest frequencies of DCT of 32x32 copy which
+// are above their median.
+func perceptualHash(img image.Image) uint64 {
+	const n = phashSampleSize
+	pixels := grayPixels(img, n, n)
+	var table [n][n]float64
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			table[k][i] = math.Cos(math.Pi * float64(k) * (2*float64(i) + 1) / (2 * n))
+		}
+	}
+	// DCT is separable: by rows first and by columns of the result
+	// then. Only 8 lowest frequencies are needed in both directions.
+	var rows [n][8]float64
+	for y := 0; y < n; y++ {
+		for k := 0; k < 8; k++ {
+			for x := 0; x < n; x++ {
+				rows[y][k] += pixels[y*n+x] * table[k][x]
+			}
+		}
+	}
+	low := make([]float64, 0, 64)
+	for k := 0; k < 8; k++ {
+		for l := 0; l < 8; l++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				sum += rows[y][l] * table[k][y]
+			}
+			low = append(low, sum)
+		}
+	}
+	sorted := append([]float64(nil), low...)
+	sort.Float64s(sorted)
+	return hashAbove(low, (sorted[31]+sorted[32])/2)
+}
+
+func hashAbove(values []float64, threshold float64) uint64 {
+	var hash uint64
+	for _, v := range values {
+		hash <<= 1
+		if v > threshold {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// Returns the brightness of the pixels of the image resized to the
+// size, row by row.
+func grayPixels(img image.Image, width, height int) []float64 {
+	small := resize.Resize(uint(width), uint(height), img, resize.Bilinear)
+	bounds := small.Bounds()
+	pixels := make([]float64, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := small.At(x, y).RGBA()
+			pixels = append(pixels, 0.299*float64(r)+0.587*float64(g)+0.114*float64(b))
+		}
+	}
+	return pixels
+}
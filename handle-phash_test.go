@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"math/bits"
+	"os"
+	"testing"
+)
+
+func loadTestImage(t *testing.T) image.Image {
+	file, err := os.Open("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestHashes_SimilarImages(t *testing.T) {
+	img := loadTestImage(t)
+	smaller := resize.Resize(300, 0, img, resize.Bicubic)
+
+	assert.True(t, bits.OnesCount64(averageHash(img)^averageHash(smaller)) <= 4)
+	assert.True(t, bits.OnesCount64(differenceHash(img)^differenceHash(smaller)) <= 4)
+	assert.True(t, bits.OnesCount64(perceptualHash(img)^perceptualHash(smaller)) <= 4)
+}
+
+func TestHashes_DifferentImages(t *testing.T) {
+	img := loadTestImage(t)
+	// Vertical gradient looks nothing like the photo.
+	gradient := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			gradient.SetGray(x, y, color.Gray{uint8(y * 4)})
+		}
+	}
+
+	assert.True(t, bits.OnesCount64(averageHash(img)^averageHash(gradient)) > 10)
+	assert.True(t, bits.OnesCount64(perceptualHash(img)^perceptualHash(gradient)) > 10)
+}
+
+func TestHashes_GradientBits(t *testing.T) {
+	gradient := image.NewGray(image.Rect(0, 0, 90, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 90; x++ {
+			gradient.SetGray(x, y, color.Gray{uint8(x * 2)})
+		}
+	}
+
+	// Brightness grows from left to right everywhere.
+	assert.Equal(t, ^uint64(0), differenceHash(gradient))
+	// The right half is brighter than the average.
+	assert.Equal(t, uint64(0x0f0f0f0f0f0f0f0f), averageHash(gradient))
+}
@@ -1,29 +1,48 @@
 package main
 
 import (
-	"github.com/nfnt/resize"
-
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"image"
-	"image/jpeg"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Useful defaults and limits that could be moved to the config in
-// production service.
+// Useful defaults and limits. Some of them could be changed in the
+// config, see config.go.
 const (
-	minSize         = 32
-	maxSize         = 8192
-	jpegQuality     = 92
-	resizeAlgorithm = resize.Bilinear
-	cachingDuration = 1 * time.Hour
+	defaultMinSize         = 32
+	defaultMaxSize         = 8192
+	defaultJPEGQuality     = 92
+	defaultResizeAlgorithm = "bilinear"
+	defaultMode            = "stretch"
+	defaultFormat          = "jpeg"
+	defaultCachingDuration = 1 * time.Hour
+	// How long the results are served stale after the caching duration
+	// while they are refreshed.
+	staleDuration = 1 * time.Hour
+	// Sources are kept shorter than the results because they are
+	// needed only while clients ask for new sizes of the same image.
+	defaultSourceCachingDuration = 10 * time.Minute
+	// Limits for loading of the sources.
+	maxSourceSize = 50 * 1024 * 1024
+	fetchTimeout  = 30 * time.Second
+	// Compressed PNG or GIF of small size could declare huge image so
+	// the pixels are limited too. That's about 400MB decoded.
+	maxSourcePixels = 100 * 1000 * 1000
+	// Limit for the body of POST requests with uploaded images.
+	maxUploadSize = 20 * 1024 * 1024
+	// Clients keep fallback images shortly, see fallback.go.
+	fallbackCachingDuration = 1 * time.Minute
+	// Failed loads are remembered shortly, see source-failures.go.
+	defaultFailureCachingDuration = 1 * time.Minute
+	defaultTimeoutCachingDuration = 10 * time.Second
 )
 
 // Implements handler for `/`. Moved out of main() for code clarity.
@@ -38,92 +57,218 @@ func handleRootRequest(w http.ResponseWriter, r *http.Request) {
 // Implements handler for `/resize`. Moved out of main() for code clarity.
 func handleResizeRequest(w http.ResponseWriter, r *http.Request) {
 	var (
-		imageURL      string
-		width, height uint64
-		err           error
+		params *resizeParams
+		err    error
 	)
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	if imageURL, width, height, err = parseParams(r); err != nil {
+	if params, err = parseParams(r); err != nil {
 		http.Error(w, fmt.Sprintf("400 request error: %s", err), http.StatusBadRequest)
 		return
 	}
+	// Uploaded images come in the body, see upload.go.
+	if r.Method == "POST" {
+		handleUpload(w, r, params)
+		return
+	}
+	serveResize(w, r, params, "")
+}
+
+// Serves the result from the caches or renders it. Common part for
+// both query and path forms of the requests. Cache-Control if given is
+// kept for the images only, not for the errors.
+func serveResize(w http.ResponseWriter, r *http.Request, params *resizeParams, cacheControl string) {
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
 	if useClientCache(w, r) {
 		return
 	}
-	if useServerCache(w, imageURL, width, height) {
+	w.Header().Set("Content-Type", contentType(params.format))
+	key := formatCacheKey(params)
+	if useServerCache(w, key, func() ([]byte, error) { return renderImage(params) }) {
 		return
 	}
-	var (
-		srcImage image.Image
-	)
-	if srcImage, err = loadURL(imageURL); err != nil {
+	data, err := renderImage(params)
+	if err != nil {
+		reportSourceFailure(params.source, err)
+		if serveFallback(w, params) {
+			return
+		}
+		w.Header().Del("Content-Type")
+		w.Header().Del("Cache-Control")
 		http.Error(w, fmt.Sprintf("426 image loading error: %s", err), http.StatusFailedDependency)
 		return
 	}
-	resizedImage := resize.Resize(uint(width), uint(height), srcImage, resizeAlgorithm)
-	opts := jpeg.Options{Quality: jpegQuality}
-	// Encoding process below could return error but the main cause of
-	// errors here are transport errors due broken connection on
-	// client side. They could be ignored safely we just skip caching
-	// of partial results.
-	buf := new(bytes.Buffer)
-	if err = jpeg.Encode(buf, resizedImage, &opts); err != nil {
-		return
+	w.Write(data)
+	storeResult(key, data)
+}
+
+// Loads the source and makes the result of it.
+func renderImage(params *resizeParams) ([]byte, error) {
+	srcImage, err := loadURL(params.source)
+	if err != nil {
+		return nil, err
 	}
-	w.Write(buf.Bytes())
-	cache.Set(formatCacheKey(imageURL, width, height), buf.Bytes(), int(cachingDuration.Seconds()))
+	return processImage(srcImage, params)
 }
 
-// When we return more than two values from the function it is good
-// choice for clarity let them names in function declaration. It is
-// better not return many values of course.
-func parseParams(r *http.Request) (imageURL string, width, height uint64, err error) {
-	var args url.Values
-	if args, err = url.ParseQuery(r.URL.RawQuery); err != nil {
-		return
+// Parameters of the resize request. Query and path forms of the
+// requests are parsed into it, see parseArgs().
+type resizeParams struct {
+	source  imageSource
+	width   uint64
+	height  uint64
+	mode    string
+	format  string
+	quality int
+	filter  string
+	// Applied to the source before resizing.
+	trim *trimParams
+	// Optional effects applied after resizing.
+	blur      float64
+	unsharp   *unsharpParams
+	adjust    *adjustParams
+	watermark *watermarkParams
+	text      *textParams
+}
+
+// Parameters with the defaults of the service.
+func (c *config) defaultParams() *resizeParams {
+	return &resizeParams{
+		mode:    defaultMode,
+		format:  defaultFormat,
+		quality: c.JPEGQuality,
+		filter:  c.ResizeAlgorithm,
 	}
-	if args.Get("url") == "" {
-		err = errors.New("non empty `url` parameter is mandatory")
-		return
+}
+
+// Parses the query of `/resize` request.
+func parseParams(r *http.Request) (*resizeParams, error) {
+	args, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
 	}
-	if args.Get("width") == "" {
-		err = errors.New("non empty `width` parameter is mandatory")
-		return
+	return parseArgs(args, r.Method == "POST")
+}
+
+// Makes the parameters of the request from its arguments. Options
+// omitted in the request are taken from the defaults of the origin
+// and then from the defaults of the service. Uploads have no source
+// in the arguments.
+func parseArgs(args url.Values, upload bool) (*resizeParams, error) {
+	var (
+		s        = currentSettings()
+		params   = s.config.defaultParams()
+		defaults transformDefaults
+		o        *namedOrigin
+		err      error
+	)
+	// Uploaded sources are in the body.
+	if !upload {
+		if params.source, o, err = s.sourceFromArgs(args); err != nil {
+			return nil, err
+		}
 	}
-	if args.Get("height") == "" {
-		err = errors.New("non empty `height` parameter is mandatory")
-		return
+	if o != nil {
+		defaults = o.defaults
 	}
-	imageURL = args.Get("url")
-	if width, err = strconv.ParseUint(args.Get("width"), 10, 64); err != nil {
-		return
+	// Presets replace the defaults of the origin and the request
+	// could not change them, see presets.go.
+	switch {
+	case args.Get("preset") != "":
+		if defaults, err = s.findPreset(args); err != nil {
+			return nil, err
+		}
+	case s.config.PresetsOnly:
+		return nil, errors.New("only presets are allowed, `preset` parameter is mandatory")
 	}
-	if width > 0 && width < minSize || width > maxSize {
-		err = errors.New("width value is out of limit")
-		return
+	widthArg, heightArg := args.Get("width"), args.Get("height")
+	if widthArg == "" && defaults.Width != nil {
+		widthArg = strconv.FormatUint(*defaults.Width, 10)
 	}
-	if height, err = strconv.ParseUint(args.Get("height"), 10, 64); err != nil {
-		return
+	if heightArg == "" && defaults.Height != nil {
+		heightArg = strconv.FormatUint(*defaults.Height, 10)
 	}
-	if height > 0 && height < minSize || height > maxSize {
-		err = errors.New("height value is out of limit")
-		return
+	if widthArg == "" {
+		return nil, errors.New("non empty `width` parameter is mandatory")
+	}
+	if heightArg == "" {
+		return nil, errors.New("non empty `height` parameter is mandatory")
+	}
+	if params.width, err = strconv.ParseUint(widthArg, 10, 64); err != nil {
+		return nil, err
+	}
+	if params.height, err = strconv.ParseUint(heightArg, 10, 64); err != nil {
+		return nil, err
+	}
+	if err = s.config.checkSize(params.width, params.height); err != nil {
+		return nil, err
+	}
+	if err = parseTransformOptions(args, defaults, params); err != nil {
+		return nil, err
+	}
+	if params.trim, err = parseTrim(args); err != nil {
+		return nil, err
+	}
+	if params.blur, err = parseBlur(args); err != nil {
+		return nil, err
+	}
+	if params.unsharp, err = parseUnsharp(args); err != nil {
+		return nil, err
+	}
+	if params.adjust, err = parseAdjustments(args); err != nil {
+		return nil, err
+	}
+	if params.watermark, err = s.parseWatermark(args); err != nil {
+		return nil, err
+	}
+	if params.text, err = s.parseText(args); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// The source could be set by full URL or by the path inside one of
+// configured origins in two forms: `src=name:path` or
+// `origin=name&path=path`.
+func (s *settings) sourceFromArgs(args url.Values) (imageSource, *namedOrigin, error) {
+	switch {
+	case args.Get("origin") != "":
+		return s.resolveSource(args.Get("origin"), args.Get("path"))
+	case args.Get("src") != "":
+		return s.parseSource(args.Get("src"))
+	case strings.HasPrefix(args.Get("url"), "data:"):
+		src, err := parseDataURI(args.Get("url"))
+		return src, nil, err
+	case args.Get("url") != "":
+		return imageSource{path: args.Get("url")}, nil, nil
+	}
+	return imageSource{}, nil, errors.New("non empty `url`, `src` or `origin` parameter is mandatory")
+}
+
+// Checks the requested size against the limits of the service. Zero
+// side is calculated from the other keeping the aspect ratio.
+func (c *config) checkSize(width, height uint64) error {
+	if width > 0 && width < c.MinSize || width > c.MaxSize {
+		return errors.New("width value is out of limit")
+	}
+	if height > 0 && height < c.MinSize || height > c.MaxSize {
+		return errors.New("height value is out of limit")
 	}
 	if width == 0 && height == 0 {
-		err = errors.New("either width or height should be greater than zero")
-		return
+		return errors.New("either width or height should be greater than zero")
 	}
-	return
+	return nil
 }
 
 // Use client cache where possible.
 func useClientCache(w http.ResponseWriter, r *http.Request) bool {
 	const sep = "X"
 	hash := fnv.New64()
-	hash.Write([]byte(r.URL.RawQuery))
+	hash.Write([]byte(r.URL.RequestURI()))
 	// Etag value has two parts: 1) hash based on URL string 2) timestamp.
 	etagHash := strconv.FormatUint(hash.Sum64(), 10)
 	etagTs := strconv.FormatInt(time.Now().Unix(), 10)
@@ -135,7 +280,7 @@ func useClientCache(w http.ResponseWriter, r *http.Request) bool {
 			// Second part of etag should be timestamp so we can check
 			// duration since previuous call for this URL.
 			clientTs, _ := strconv.ParseInt(partsOfEtag[1], 10, 64)
-			if time.Since(time.Unix(clientTs, 0)) < cachingDuration {
+			if time.Since(time.Unix(clientTs, 0)) < currentSettings().config.CachingDuration {
 				w.WriteHeader(http.StatusNotModified)
 				return true
 			}
@@ -146,36 +291,136 @@ func useClientCache(w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
-// Inmem cache with LRU. Keys expired after `cachingDuration`.
-func useServerCache(w http.ResponseWriter, url string, width, height uint64) bool {
+// Inmem cache with LRU. Results are fresh for the caching duration
+// and then served stale for `staleDuration` more while they are
+// refreshed in background, so hot images never expire in clients'
+// faces. Without `refresh` function stale results are not used.
+func useServerCache(w http.ResponseWriter, key []byte, refresh func() ([]byte, error)) bool {
 	var (
-		data []byte
-		err  error
+		value []byte
+		err   error
 	)
-	if data, err = cache.Get(formatCacheKey(url, width, height)); err != nil {
+	if value, err = cache.Get(key); err != nil {
 		return false
 	}
+	softExpireAt, data := decodeResult(value)
+	if time.Now().After(softExpireAt) {
+		if refresh == nil {
+			return false
+		}
+		scheduleRefresh(key, refresh)
+	}
 	w.Write(data)
 	return true
 }
 
-// Loads data from URL and try to convert it to JPEG.
-func loadURL(imageURL string) (image.Image, error) {
-	resp, err := http.Get(imageURL)
-	if err != nil {
-		return nil, err
+// Keys of the results under refreshing. Only one refresh runs for
+// each key whatever number of stale hits it got.
+var refreshing = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+func scheduleRefresh(key []byte, refresh func() ([]byte, error)) {
+	refreshing.Lock()
+	defer refreshing.Unlock()
+	if refreshing.keys[string(key)] {
+		return
+	}
+	refreshing.keys[string(key)] = true
+	go func() {
+		// On failure stale result still served until it expires
+		// completely, the next stale hit will try again.
+		if data, err := refresh(); err == nil {
+			storeResult(key, data)
+		}
+		refreshing.Lock()
+		delete(refreshing.keys, string(key))
+		refreshing.Unlock()
+	}()
+}
+
+// Stores the result with soft expiry in the first 8 bytes of the
+// value. Hard expiry is TTL of the cache entry.
+func storeResult(key, data []byte) {
+	cachingDuration := currentSettings().config.CachingDuration
+	value := encodeResult(data, time.Now().Add(cachingDuration))
+	cache.Set(key, value, int((cachingDuration + staleDuration).Seconds()))
+}
+
+func encodeResult(data []byte, softExpireAt time.Time) []byte {
+	value := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(softExpireAt.Unix()))
+	copy(value[8:], data)
+	return value
+}
+
+func decodeResult(value []byte) (softExpireAt time.Time, data []byte) {
+	if len(value) < 8 {
+		return time.Time{}, nil
 	}
-	defer resp.Body.Close()
-	return jpeg.Decode(resp.Body)
+	return time.Unix(int64(binary.BigEndian.Uint64(value)), 0), value[8:]
 }
 
-// Helper for making the key for caching in single place.
-func formatCacheKey(url string, width, height uint64) []byte {
+// Helper for making the key for caching in single place. The source
+// goes first so all the results for it could be found by prefix.
+func formatCacheKey(params *resizeParams) []byte {
 	buf := new(bytes.Buffer)
-	buf.WriteString(url)
+	buf.WriteString(params.source.String())
+	buf.WriteRune(':')
+	buf.WriteString(strconv.FormatUint(params.width, 10))
+	buf.WriteRune(':')
+	buf.WriteString(strconv.FormatUint(params.height, 10))
 	buf.WriteRune(':')
-	buf.WriteString(strconv.FormatUint(width, 10))
+	buf.WriteString(params.mode)
 	buf.WriteRune(':')
-	buf.WriteString(strconv.FormatUint(height, 10))
+	buf.WriteString(params.format)
+	buf.WriteRune(':')
+	buf.WriteString(strconv.Itoa(params.quality))
+	buf.WriteRune(':')
+	buf.WriteString(params.filter)
+	if params.trim != nil {
+		buf.WriteString(":trim=")
+		buf.WriteString(params.trim.String())
+	}
+	if params.blur > 0 {
+		buf.WriteString(":blur=")
+		buf.WriteString(strconv.FormatFloat(params.blur, 'g', -1, 64))
+	}
+	if params.unsharp != nil {
+		buf.WriteString(":unsharp=")
+		buf.WriteString(params.unsharp.String())
+	}
+	if params.adjust != nil {
+		buf.WriteString(":adj=")
+		buf.WriteString(params.adjust.String())
+	}
+	if params.watermark != nil {
+		buf.WriteString(":wm=")
+		buf.WriteString(params.watermark.String())
+	}
+	if params.text != nil {
+		buf.WriteString(":text=")
+		buf.WriteString(params.text.String())
+	}
 	return buf.Bytes()
 }
+
+// Removes all the results rendered from the source. Freecache has
+// no lookup by key prefix so the whole cache iterated. Keys collected
+// first because deletion during iteration could skip entries.
+func deleteResults(source string) {
+	var (
+		prefix = append([]byte(source), ':')
+		keys   [][]byte
+	)
+	iter := cache.NewIterator()
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		if bytes.HasPrefix(entry.Key, prefix) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	for _, key := range keys {
+		cache.Del(key)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Origin for loading sources over HTTP. With the base URL the paths
+// are relative to it so clients don't see hostnames of the
+// upstreams. Without the base URL the path is absolute URL itself.
+type httpOrigin struct {
+	base    *url.URL
+	headers map[string]string
+	client  *http.Client
+	maxSize int64
+}
+
+func newHTTPOrigin(cfg originConfig) (*httpOrigin, error) {
+	if cfg.BaseURL == "" {
+		return nil, fmt.Errorf("`base_url` is mandatory for http origin")
+	}
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("`base_url` should be absolute HTTP(S) URL")
+	}
+	return &httpOrigin{
+		base:    base,
+		headers: cfg.Headers,
+		client:  cfg.client(),
+		maxSize: cfg.maxSize(),
+	}, nil
+}
+
+func (o *httpOrigin) checkPath(path string) error {
+	if o.base == nil {
+		return nil
+	}
+	return checkRelativePath(path)
+}
+
+// Downloads the source. When `cached` is set the request is
+// conditional and `cached` itself returned if it is not modified.
+func (o *httpOrigin) fetch(path string, cached *sourceEntry) (*sourceEntry, error) {
+	req, err := http.NewRequest("GET", o.resolve(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range o.headers {
+		req.Header.Set(name, value)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := doWithRetries(o.client, req)
+	if err != nil {
+		return nil, classifyNetError(err)
+	}
+	defer resp.Body.Close()
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		return cached, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &sourceError{class: failureNotFound, msg: "source returned " + resp.Status}
+	default:
+		return nil, fmt.Errorf("source returned %s", resp.Status)
+	}
+	if resp.ContentLength > o.maxSize {
+		return nil, errSourceTooLarge
+	}
+	entry := &sourceEntry{
+		etag:         resp.Header.Get("Etag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if entry.data, err = readLimited(resp.Body, o.maxSize); err != nil {
+		return nil, classifyNetError(err)
+	}
+	return entry, nil
+}
+
+// The path is appended to the path of the base URL as is, so it
+// could not point to another host.
+func (o *httpOrigin) resolve(path string) string {
+	if o.base == nil {
+		return path
+	}
+	u := *o.base
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.TrimLeft(path, "/")
+	u.RawPath = ""
+	return u.String()
+}
@@ -4,18 +4,34 @@ import (
 	"github.com/coocood/freecache"
 	"github.com/stretchr/testify/assert"
 
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 const (
-	uniqImageSize = minSize + 2 // for avoiding caching during the tests, all other requests use minSize+1
+	uniqImageSize  = defaultMinSize + 2 // for avoiding caching during the tests, all other requests use defaultMinSize+1
+	testAdminToken = "secret"
 )
 
 var (
@@ -29,23 +45,79 @@ var (
 func TestMain(m *testing.M) {
 	flag.StringVar(&hostPort, "listen-at", "localhost:8080", "listen for HTTP requests at host:port")
 	flag.Parse()
+	adminToken = testAdminToken
 
 	goodImageURL = "http://" + hostPort + "/static/l_hires.jpg"
 	brokenImageURL = "http://" + hostPort + "/static/nonjpeg.jpg"
 
-	cache = freecache.NewCache(cacheSize)
+	// Catalog origin points to the same static files as other tests
+	// use but with restrictions and defaults.
+	defaultWidth := uint64(defaultMinSize + 1)
+	testOrigins := map[string]originConfig{
+		"local": {Type: "local", Root: "testdata"},
+		"catalog": {
+			Type:         "http",
+			BaseURL:      "http://" + hostPort + "/static",
+			AllowedPaths: []string{"/l_"},
+			Headers:      map[string]string{"X-Origin-Token": "catalog"},
+			Defaults:     transformDefaults{Width: &defaultWidth},
+		},
+	}
+	presetWidth, presetQuality := uint64(defaultMinSize*2), 70
+	testPresets := map[string]transformDefaults{
+		"card":    {Width: &presetWidth, Mode: "fit", Format: "png"},
+		"thumb@2": {Width: &presetWidth, Height: &presetWidth, Mode: "fill", Quality: &presetQuality},
+	}
+	cfg := defaultConfig()
+	cfg.Origins, cfg.Presets = testOrigins, testPresets
+	cfg.Watermarks = map[string]watermarkConfig{"logo": {Path: "testdata/watermark.png", Margin: 2}}
+	cfg.Fonts = map[string]string{"regular": "testdata/goregular.ttf"}
+	s, err := newSettings(cfg)
+	if err != nil {
+		panic(err)
+	}
+	current.Store(s)
 
+	cache = freecache.NewCache(defaultCacheSize)
+	sources = newSourceCache(defaultSourceCacheSize)
+	failures = freecache.NewCache(failureCacheSize)
+
+	mux := http.NewServeMux()
 	// Testing only handler with pictures samples:
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("testdata"))))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("testdata"))))
 
 	// Handlers that should be tested:
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handleRootRequest(w, r)
 	})
-	http.HandleFunc("/resize", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/resize", func(w http.ResponseWriter, r *http.Request) {
 		handleResizeRequest(w, r)
 	})
-	go func() { http.ListenAndServe(hostPort, nil) }()
+	mux.HandleFunc(pathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		handlePathRequest(w, r)
+	})
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		handleInfoRequest(w, r)
+	})
+	mux.HandleFunc("/palette", func(w http.ResponseWriter, r *http.Request) {
+		handlePaletteRequest(w, r)
+	})
+	mux.HandleFunc("/phash", func(w http.ResponseWriter, r *http.Request) {
+		handlePHashRequest(w, r)
+	})
+	mux.HandleFunc("/compare", func(w http.ResponseWriter, r *http.Request) {
+		handleCompareRequest(w, r)
+	})
+	mux.HandleFunc("/admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminCacheRequest(w, r)
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminStatsRequest(w, r)
+	})
+	mux.HandleFunc("/admin/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminMetricsRequest(w, r)
+	})
+	go func() { http.ListenAndServe(hostPort, mux) }()
 	time.Sleep(100 * time.Millisecond)
 	ret := m.Run()
 	os.Exit(ret)
@@ -134,7 +206,7 @@ func TestGetResize_NoSizes(t *testing.T) {
 }
 
 func TestGetResize_NoHeight(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d", hostPort, goodImageURL, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d", hostPort, goodImageURL, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -143,7 +215,7 @@ func TestGetResize_NoHeight(t *testing.T) {
 }
 
 func TestGetResize_NoWidth(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d", hostPort, goodImageURL, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d", hostPort, goodImageURL, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -152,7 +224,7 @@ func TestGetResize_NoWidth(t *testing.T) {
 }
 
 func TestGetResize_SourceImageDoesntExists(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=notexisted.jpeg&height=%d&width=%d", hostPort, minSize+1, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=notexisted.jpeg&height=%d&width=%d", hostPort, defaultMinSize+1, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -161,7 +233,7 @@ func TestGetResize_SourceImageDoesntExists(t *testing.T) {
 }
 
 func TestGetResize_Ok(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d", hostPort, goodImageURL, minSize+1, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d", hostPort, goodImageURL, defaultMinSize+1, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -170,7 +242,7 @@ func TestGetResize_Ok(t *testing.T) {
 }
 
 func TestGetResize_NonJpeg(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d", hostPort, brokenImageURL, minSize+1, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d", hostPort, brokenImageURL, defaultMinSize+1, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -179,7 +251,7 @@ func TestGetResize_NonJpeg(t *testing.T) {
 }
 
 func TestGetResize_ExceedWidthLimit(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d&width=%d", hostPort, goodImageURL, minSize+1, maxSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d&width=%d", hostPort, goodImageURL, defaultMinSize+1, defaultMaxSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -188,7 +260,7 @@ func TestGetResize_ExceedWidthLimit(t *testing.T) {
 }
 
 func TestGetResize_ExceedHeightLimit(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d&width=%d", hostPort, goodImageURL, maxSize+1, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&height=%d&width=%d", hostPort, goodImageURL, defaultMaxSize+1, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -197,7 +269,7 @@ func TestGetResize_ExceedHeightLimit(t *testing.T) {
 }
 
 func TestGetResize_KeepRatioByWidth(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=0&height=%d", hostPort, goodImageURL, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=0&height=%d", hostPort, goodImageURL, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -206,7 +278,7 @@ func TestGetResize_KeepRatioByWidth(t *testing.T) {
 }
 
 func TestGetResize_KeepRatioByHeight(t *testing.T) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, goodImageURL, minSize+1))
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, goodImageURL, defaultMinSize+1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -228,3 +300,996 @@ func TestGetResize_CheckForEtag(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, resp.Header.Get("Etag"), writtenResp.Header.Get("Etag"))
 }
+
+func TestGetResize_SourceCached(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, goodImageURL, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+	src, fresh := sources.get(goodImageURL)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, fresh)
+	assert.NotEmpty(t, src.data)
+	assert.NotEmpty(t, src.lastModified)
+}
+
+// Origin with ETag support which counts full downloads.
+func newVersionedOrigin(version *string, downloads *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + *version + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		*downloads++
+		w.Header().Set("Etag", etag)
+		fmt.Fprint(w, *version)
+	}))
+}
+
+func TestFetchURL_RevalidatesExpiredSource(t *testing.T) {
+	version, downloads := "v1", 0
+	origin := newVersionedOrigin(&version, &downloads)
+	defer origin.Close()
+	if _, err := fetchSource(imageSource{path: origin.URL}); err != nil {
+		t.Error(err)
+	}
+	sources.extend(origin.URL, -time.Second)
+	src, err := fetchSource(imageSource{path: origin.URL})
+	if err != nil {
+		t.Error(err)
+	}
+	_, fresh := sources.get(origin.URL)
+
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, "v1", string(src.data))
+	assert.True(t, fresh)
+}
+
+// Changes copy of the settings for the test. Returned function
+// restores the previous settings.
+func changeSettings(change func(s *settings)) (restore func()) {
+	old := currentSettings()
+	s, cfg := *old, *old.config
+	s.config = &cfg
+	s.origins = make(map[string]*namedOrigin, len(old.origins))
+	for name, o := range old.origins {
+		s.origins[name] = o
+	}
+	change(&s)
+	current.Store(&s)
+	return func() { current.Store(old) }
+}
+
+// Key of the result with default options of the service.
+func resultKey(source string, width, height uint64) []byte {
+	params := currentSettings().config.defaultParams()
+	params.source = imageSource{path: source}
+	params.width, params.height = width, height
+	return formatCacheKey(params)
+}
+
+// Waits for the result deleted in the background.
+func waitForDeletion(key []byte) bool {
+	for i := 0; i < 100; i++ {
+		if _, err := cache.Get(key); err == freecache.ErrNotFound {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFetchURL_ChangedSourceDropsResults(t *testing.T) {
+	version, downloads := "v1", 0
+	origin := newVersionedOrigin(&version, &downloads)
+	defer origin.Close()
+	if _, err := fetchSource(imageSource{path: origin.URL}); err != nil {
+		t.Error(err)
+	}
+	key := resultKey(origin.URL, defaultMinSize, defaultMinSize)
+	cache.Set(key, []byte("rendered from v1"), 0)
+	sources.extend(origin.URL, -time.Second)
+	version = "v2"
+	src, err := fetchSource(imageSource{path: origin.URL})
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, 2, downloads)
+	assert.Equal(t, "v2", string(src.data))
+	assert.True(t, waitForDeletion(key), "results of the old version should be deleted")
+}
+
+func adminRequest(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+hostPort+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return http.DefaultClient.Do(req)
+}
+
+func TestAdminCache_Unauthorized(t *testing.T) {
+	req, err := http.NewRequest("DELETE", "http://"+hostPort+"/admin/cache", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAdminCache_ListAndDeleteKey(t *testing.T) {
+	key := "admin-test:1:1"
+	cache.Set([]byte(key), []byte("data"), 60)
+	resp, err := adminRequest("GET", "/admin/cache?prefix=admin-test:")
+	if err != nil {
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+	var entries []adminCacheEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Error(err)
+	}
+	delResp, err := adminRequest("DELETE", "/admin/cache?key="+url.QueryEscape(key))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = cache.Get([]byte(key))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, key, entries[0].Key)
+		assert.Equal(t, 4, entries[0].Size)
+		assert.True(t, entries[0].TTL > 0 && entries[0].TTL <= 60)
+	}
+	assert.Equal(t, http.StatusNoContent, delResp.StatusCode)
+	assert.Equal(t, freecache.ErrNotFound, err)
+}
+
+func TestAdminCache_DeleteSourceVariants(t *testing.T) {
+	const source = "http://admin-test/source.jpg"
+	cache.Set(resultKey(source, defaultMinSize, 0), []byte("data"), 60)
+	cache.Set(resultKey(source, 0, defaultMinSize), []byte("data"), 60)
+	resp, err := adminRequest("DELETE", "/admin/cache?url="+url.QueryEscape(source))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.True(t, waitForDeletion(resultKey(source, defaultMinSize, 0)))
+	assert.True(t, waitForDeletion(resultKey(source, 0, defaultMinSize)))
+}
+
+func TestAdminCache_DeleteWithoutTarget(t *testing.T) {
+	key := "admin-test:kept"
+	cache.Set([]byte(key), []byte("data"), 60)
+	resp, err := adminRequest("DELETE", "/admin/cache?ulr="+url.QueryEscape("http://admin-test/source.jpg"))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = cache.Get([]byte(key))
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, err)
+}
+
+func TestAdminCache_Clear(t *testing.T) {
+	key := "admin-test:cleared"
+	cache.Set([]byte(key), []byte("data"), 60)
+	resp, err := adminRequest("DELETE", "/admin/cache?all=1")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = cache.Get([]byte(key))
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, freecache.ErrNotFound, err)
+}
+
+func TestAdminStats_Reset(t *testing.T) {
+	cache.Get([]byte("admin-test:missed"))
+	resp, err := adminRequest("DELETE", "/admin/stats")
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, int64(0), cache.LookupCount())
+}
+
+func TestAdminMetrics(t *testing.T) {
+	reportSourceFailure(imageSource{path: "http://admin-test/metrics.jpg"}, &sourceError{class: failureTimeout})
+	resp, err := adminRequest("GET", "/admin/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var metrics adminMetrics
+	if err = json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, metrics.SourceFailures["timeout"] > 0)
+}
+
+func TestAdminMetrics_Unauthorized(t *testing.T) {
+	resp, err := http.Get("http://" + hostPort + "/admin/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugResp, err := http.Get("http://" + hostPort + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, http.StatusNotFound, debugResp.StatusCode)
+}
+
+// Origin which always responds with the status and counts requests.
+func newFailingOrigin(status int, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.WriteHeader(status)
+	}))
+}
+
+func TestLoadURL_NotFoundCached(t *testing.T) {
+	requests := 0
+	origin := newFailingOrigin(http.StatusNotFound, &requests)
+	defer origin.Close()
+	_, err1 := loadURL(imageSource{path: origin.URL})
+	_, err2 := loadURL(imageSource{path: origin.URL})
+
+	assert.Equal(t, 1, requests)
+	if assert.IsType(t, &sourceError{}, err2) {
+		assert.Equal(t, failureNotFound, err2.(*sourceError).class)
+	}
+	assert.EqualError(t, err2, err1.Error())
+}
+
+func TestLoadURL_ServerErrorNotCached(t *testing.T) {
+	requests := 0
+	origin := newFailingOrigin(http.StatusServiceUnavailable, &requests)
+	defer origin.Close()
+	loadURL(imageSource{path: origin.URL})
+	loadURL(imageSource{path: origin.URL})
+
+	// Each load is retried.
+	assert.Equal(t, 2*(maxFetchRetries+1), requests)
+}
+
+func TestLoadURL_NonImageCached(t *testing.T) {
+	loadURL(imageSource{path: brokenImageURL})
+	err := cachedFailure(brokenImageURL)
+
+	if assert.IsType(t, &sourceError{}, err) {
+		assert.Equal(t, failureNotImage, err.(*sourceError).class)
+	}
+}
+
+func TestGetResize_ServesStaleAndRefreshes(t *testing.T) {
+	const size = defaultMinSize + 3
+	key := resultKey(goodImageURL, size, size)
+	cache.Set(key, encodeResult([]byte("stale"), time.Now().Add(-time.Second)), 60)
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d", hostPort, goodImageURL, size, size))
+	if err != nil {
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	var softExpireAt time.Time
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if value, err := cache.Get(key); err == nil {
+			if softExpireAt, _ = decodeResult(value); time.Now().Before(softExpireAt) {
+				break
+			}
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "stale", string(data))
+	assert.True(t, time.Now().Before(softExpireAt), "stale result should be refreshed in background")
+}
+
+func TestGetResize_LocalOrigin(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=local:l_hires.jpg&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestGetResize_LocalOriginNotFound(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=local:not-existed.jpg&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusFailedDependency, resp.StatusCode)
+}
+
+func TestGetResize_LocalOriginTraversal(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=local:../main.go&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_UnknownOrigin(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=unknown:l_hires.jpg&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_NamedOrigin(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?origin=catalog&path=/l_hires.jpg&height=0", hostPort))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestGetResize_NamedOriginPathNotAllowed(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?origin=catalog&path=/nonjpeg.jpg&height=0", hostPort))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_NamedOriginTraversal(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?origin=catalog&path=/l_/../../resize&height=0", hostPort))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPOrigin_SendsHeadersAndLimits(t *testing.T) {
+	var token string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Origin-Token")
+		w.Write(make([]byte, 100))
+	}))
+	defer upstream.Close()
+	o, err := newHTTPOrigin(originConfig{
+		BaseURL: upstream.URL + "/base/",
+		Headers: map[string]string{"X-Origin-Token": "secret"},
+		MaxSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.fetch("/a.jpg", nil)
+
+	assert.Equal(t, upstream.URL+"/base/a.jpg", o.resolve("/a.jpg"))
+	assert.Equal(t, "secret", token)
+	assert.Equal(t, errSourceTooLarge, err)
+}
+
+func TestPostResize_RawBody(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=%d&height=0", hostPort, defaultMinSize+1), "image/jpeg", bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+	_, err = jpeg.Decode(resp.Body)
+	sum := sha256.Sum256(data)
+	_, cacheErr := cache.Get(resultKey("upload:"+hex.EncodeToString(sum[:]), defaultMinSize+1, 0))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, err)
+	assert.Equal(t, freecache.ErrNotFound, cacheErr, "uploads without `cache=1` should not be cached")
+}
+
+func TestPostResize_MultipartCached(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("comment", "skipped")
+	part, err := form.CreateFormFile("image", "l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=0&height=%d&cache=1&hash=%s", hostPort, defaultMinSize+1, hash), form.FormDataContentType(), body)
+	if err != nil {
+		t.Error(err)
+	}
+	_, cacheErr := cache.Get(resultKey("upload:"+hash, 0, defaultMinSize+1))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, cacheErr)
+}
+
+func TestPostResize_CachedContentType(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	query := fmt.Sprintf("http://%s/resize?width=%d&height=0&format=lqip&cache=1&hash=%s", hostPort, defaultMinSize+1, hex.EncodeToString(sum[:]))
+	var types []string
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(query, "image/jpeg", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		types = append(types, resp.Header.Get("Content-Type"))
+	}
+
+	assert.Equal(t, []string{"application/json", "application/json"}, types)
+}
+
+func TestReadUpload_MultipartTooLarge(t *testing.T) {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("comment", string(make([]byte, 2*maxUploadSize)))
+	form.Close()
+	r := httptest.NewRequest("POST", "/resize", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	_, err := readUpload(httptest.NewRecorder(), r)
+
+	assert.Equal(t, errSourceTooLarge, err)
+}
+
+// PNG header declaring the image of the size without the pixels.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	copy(ihdr[12:], []byte{8, 6, 0, 0, 0})
+	buf := bytes.NewBufferString("\x89PNG\r\n\x1a\n")
+	binary.Write(buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+func TestDecodeImage_TooManyPixels(t *testing.T) {
+	_, err := decodeImage(pngHeader(50000, 50000))
+
+	assert.Equal(t, errSourceTooLarge, err)
+}
+
+func TestPostResize_TooManyPixels(t *testing.T) {
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=%d&height=0", hostPort, defaultMinSize+1), "image/png", bytes.NewReader(pngHeader(50000, 50000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestPostResize_WrongHash(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=%d&height=0&cache=1&hash=0000", hostPort, defaultMinSize+1), "image/jpeg", bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPostResize_NonImage(t *testing.T) {
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=%d&height=0", hostPort, defaultMinSize+1), "image/jpeg", strings.NewReader("not an image"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func countSourceFailures(class string) int64 {
+	return sourceFailureCounts()[class]
+}
+
+func TestGetResize_Fallback(t *testing.T) {
+	fallback, err := newFallback("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changeSettings(func(s *settings) { s.fallback = fallback })()
+	before := countSourceFailures("not_found")
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=local:fallback-test.jpg&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+	img, err := jpeg.Decode(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Fallback"))
+	assert.Empty(t, resp.Header.Get("Etag"))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMinSize+1, img.Bounds().Dx())
+	assert.Equal(t, before+1, countSourceFailures("not_found"))
+}
+
+func TestGetResize_NoFallback(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?src=local:fallback-test.jpg&width=%d&height=0", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusFailedDependency, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Fallback"))
+}
+
+func makeDataURI(t *testing.T) (uri string, sum string) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), hex.EncodeToString(hash[:])
+}
+
+func TestGetResize_DataURI(t *testing.T) {
+	uri, sum := makeDataURI(t)
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, url.QueryEscape(uri), defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+	_, cacheErr := cache.Get(resultKey("data:sha256:"+sum, defaultMinSize+1, 0))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, cacheErr)
+}
+
+func TestGetResize_DataURINotImage(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, url.QueryEscape("data:text/plain,hello"), defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestParseDataURI(t *testing.T) {
+	src, err := parseDataURI("data:image/gif,GIF89a%01")
+	_, tooLongErr := parseDataURI("data:image/png;base64," + strings.Repeat("A", maxDataURILength))
+	_, brokenErr := parseDataURI("data:image/png;base64,!!!")
+	_, noCommaErr := parseDataURI("data:image/png;base64")
+	// Unescaped `+` of base64 turns into space in query strings.
+	spaced, spacedErr := parseDataURI("data:image/png;base64,a b=")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "GIF89a\x01", string(src.data))
+	assert.Error(t, tooLongErr)
+	assert.Error(t, brokenErr)
+	assert.Error(t, noCommaErr)
+	assert.NoError(t, spacedErr)
+	assert.Equal(t, []byte{0x6b, 0xe6}, spaced.data)
+}
+
+func TestGetPath_Resize(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx,png/%s", hostPort, defaultMinSize+1, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "public")
+}
+
+func TestGetPath_LoadingErrorNotCached(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx/local:not-existed.jpg", hostPort, defaultMinSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusFailedDependency, resp.StatusCode)
+	assert.NotContains(t, resp.Header.Get("Cache-Control"), "public")
+	assert.NotContains(t, resp.Header.Get("Cache-Control"), "max-age")
+}
+
+func TestGetPath_BadOptions(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx,webp/%s", hostPort, defaultMinSize+1, url.PathEscape(goodImageURL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_FillMode(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=%d&mode=fill&format=png", hostPort, goodImageURL, defaultMinSize, defaultMinSize*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(resp.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(defaultMinSize, defaultMinSize*2), img.Bounds().Size())
+}
+
+func TestGetResize_Preset(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&preset=thumb@2", hostPort, goodImageURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(resp.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(defaultMinSize*2, defaultMinSize*2), img.Bounds().Size())
+}
+
+func TestGetResize_PresetWithOwnOptions(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&preset=card&width=%d", hostPort, goodImageURL, defaultMinSize))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_UnknownPreset(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&preset=huge", hostPort, goodImageURL))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_PresetsOnly(t *testing.T) {
+	defer changeSettings(func(s *settings) { s.config.PresetsOnly = true })()
+	refused, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0", hostPort, goodImageURL, defaultMinSize))
+	if err != nil {
+		t.Error(err)
+	}
+	allowed, err := http.Get(fmt.Sprintf("http://%s/r/card/%s", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, refused.StatusCode)
+	assert.Equal(t, http.StatusOK, allowed.StatusCode)
+	assert.Equal(t, "image/png", allowed.Header.Get("Content-Type"))
+	for _, effect := range []string{"blur=50", "unsharp=50", "trim=1", "brightness=10", "watermark=logo", "wm_opacity=0.5", "text=Sale"} {
+		resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&preset=card&%s", hostPort, goodImageURL, effect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		pathResp, err := http.Get(fmt.Sprintf("http://%s/r/card,%s/%s", hostPort, effect, url.QueryEscape(goodImageURL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pathResp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, effect)
+		assert.Equal(t, http.StatusBadRequest, pathResp.StatusCode, effect)
+	}
+}
+
+func getInfo(t *testing.T, query string) (int, imageInfo) {
+	var info imageInfo
+	resp, err := http.Get(fmt.Sprintf("http://%s/info?%s", hostPort, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, info
+}
+
+func TestGetInfo_JPEG(t *testing.T) {
+	status, info := getInfo(t, "url="+url.QueryEscape(goodImageURL))
+	data, err := ioutil.ReadFile("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, imageInfo{
+		Width: 1084, Height: 2318, Format: "jpeg", Size: len(data),
+		ColorModel: "ycbcr", Orientation: 1, HasAlpha: false,
+	}, info)
+}
+
+func TestGetInfo_DataURIWithAlpha(t *testing.T) {
+	uri, _ := makeDataURI(t)
+	status, info := getInfo(t, "url="+url.QueryEscape(uri))
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "png", info.Format)
+	assert.Equal(t, 64, info.Width)
+	assert.Equal(t, 48, info.Height)
+	assert.True(t, info.HasAlpha)
+}
+
+func TestGetInfo_NotImage(t *testing.T) {
+	status, _ := getInfo(t, "url="+url.QueryEscape(brokenImageURL))
+
+	assert.Equal(t, http.StatusFailedDependency, status)
+}
+
+func TestGetInfo_NoSource(t *testing.T) {
+	status, _ := getInfo(t, "width=100")
+
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestGetPalette(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/palette?url=%s&n=3", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var palette []paletteColor
+	err = json.NewDecoder(resp.Body).Decode(&palette)
+	_, cacheErr := cache.Get([]byte(goodImageURL + ":palette:3"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Len(t, palette, 3)
+	assert.NoError(t, cacheErr)
+}
+
+func TestGetPalette_BadN(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/palette?url=%s&n=100", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_BlurHash(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&format=blurhash", hostPort, goodImageURL, defaultMinSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Len(t, data, 28)
+}
+
+func TestGetPath_LQIP(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx,lqip/%s", hostPort, defaultMinSize+1, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result lqipResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, defaultMinSize+1, result.Width)
+	assert.Contains(t, result.DataURI, "data:image/jpeg;base64,")
+}
+
+func TestGetPHash(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/phash?url=%s", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var hashes imageHashes
+	err = json.NewDecoder(resp.Body).Decode(&hashes)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, hashes.AHash, 16)
+	assert.Len(t, hashes.DHash, 16)
+	assert.Len(t, hashes.PHash, 16)
+}
+
+func TestGetCompare(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/compare?url1=%s&src2=local:l_hires.jpg", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var distances hashDistances
+	err = json.NewDecoder(resp.Body).Decode(&distances)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, hashDistances{}, distances, "the same image from different sources")
+}
+
+func TestGetCompare_MissingSource(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/compare?url1=%s", hostPort, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_Watermark(t *testing.T) {
+	plain, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&format=png", hostPort, goodImageURL, defaultMaxSize/16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Body.Close()
+	marked, err := http.Get(fmt.Sprintf("http://%s/r/%dx,png,watermark=logo,wm_position=top-left/%s", hostPort, defaultMaxSize/16, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer marked.Body.Close()
+	plainImg, _, err1 := image.Decode(plain.Body)
+	markedImg, _, err2 := image.Decode(marked.Body)
+
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	// White frame of the watermark at its top-left corner.
+	r, g, b, _ := markedImg.At(2, 2).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0xffff, 0xffff}, []uint32{r, g, b})
+	assert.Equal(t, color.RGBAModel.Convert(plainImg.At(100, 100)), color.RGBAModel.Convert(markedImg.At(100, 100)))
+}
+
+func TestGetResize_UnknownWatermark(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&watermark=none", hostPort, goodImageURL, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_Text(t *testing.T) {
+	plain, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&format=png", hostPort, goodImageURL, defaultMaxSize/16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Body.Close()
+	boxed, err := http.Get(fmt.Sprintf("http://%s/r/%dx,png,text=Sale,text_position=top-left,text_margin=0,text_box=00ff00/%s", hostPort, defaultMaxSize/16, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boxed.Body.Close()
+	plainImg, _, err1 := image.Decode(plain.Body)
+	boxedImg, _, err2 := image.Decode(boxed.Body)
+
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	// Padding of the box at its top-left corner.
+	r, g, b, _ := boxedImg.At(1, 1).RGBA()
+	assert.Equal(t, []uint32{0, 0xffff, 0}, []uint32{r, g, b})
+	assert.Equal(t, color.RGBAModel.Convert(plainImg.At(300, 300)), color.RGBAModel.Convert(boxedImg.At(300, 300)))
+}
+
+func TestGetResize_TextInCacheKey(t *testing.T) {
+	first, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&text=first", hostPort, goodImageURL, defaultMinSize+3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+	second, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&text=second", hostPort, goodImageURL, defaultMinSize+3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Body.Close()
+	firstBody, _ := ioutil.ReadAll(first.Body)
+	secondBody, _ := ioutil.ReadAll(second.Body)
+
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Equal(t, http.StatusOK, second.StatusCode)
+	assert.NotEqual(t, firstBody, secondBody)
+}
+
+func TestGetResize_TextTooLong(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&text=%s", hostPort, goodImageURL, defaultMinSize+1, strings.Repeat("a", maxTextLength+1)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_Grayscale(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx,png,grayscale=1,contrast=10/%s", hostPort, defaultMinSize+5, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	img, _, err := image.Decode(resp.Body)
+
+	assert.NoError(t, err)
+	r, g, b, _ := img.At(10, 10).RGBA()
+	assert.Equal(t, r, g)
+	assert.Equal(t, r, b)
+}
+
+func TestGetResize_AdjustmentOutOfRange(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&brightness=200", hostPort, goodImageURL, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetResize_BlurAndUnsharp(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/r/%dx,blur=2,unsharp=1:0.5/%s", hostPort, defaultMinSize+7, url.QueryEscape(goodImageURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, _, err = image.Decode(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, err)
+}
+
+func TestGetResize_BlurOutOfRange(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/resize?url=%s&width=%d&height=0&blur=100", hostPort, goodImageURL, defaultMinSize+1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPostResize_Trim(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(src, src.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(50, 0, 150, 100), image.Black, image.Point{}, draw.Src)
+	var body bytes.Buffer
+	png.Encode(&body, src)
+	resp, err := http.Post(fmt.Sprintf("http://%s/resize?width=%d&height=0&format=png&trim=1", hostPort, defaultMinSize*2), "image/png", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	img, _, err := image.Decode(resp.Body)
+
+	assert.NoError(t, err)
+	// The square without the white borders is resized.
+	assert.Equal(t, image.Rect(0, 0, defaultMinSize*2, defaultMinSize*2), img.Bounds())
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, color.RGBAModel.Convert(img.At(1, 1)))
+}
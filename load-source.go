@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// The client for loading the sources. Default client has no timeout
+// at all.
+var (
+	sourceClient      = &http.Client{Timeout: fetchTimeout}
+	errSourceTooLarge = &sourceError{class: failureTooLarge, msg: "source is too large"}
+	// Plain URLs from `url` parameter are loaded with the default
+	// limits.
+	urlOrigin = &httpOrigin{client: sourceClient, maxSize: maxSourceSize}
+)
+
+// Where the source image is taken from: either absolute URL or the
+// path inside one of configured origins. Inline sources from `data:`
+// URIs carry the image itself and their path is the hash of it.
+type imageSource struct {
+	origin string
+	path   string
+	data   []byte
+}
+
+// The string is used as key for all the caches. Sources from the
+// origins look like `origin:path`.
+func (s imageSource) String() string {
+	if s.origin == "" {
+		return s.path
+	}
+	return s.origin + ":" + s.path
+}
+
+// Loads data from URL and try to convert it to JPEG. The failures
+// which likely repeat are returned from the cache without touching
+// the upstream.
+func loadURL(src imageSource) (image.Image, error) {
+	if err := cachedFailure(src.String()); err != nil {
+		return nil, err
+	}
+	img, err := decodeSource(src)
+	if err != nil {
+		rememberFailure(src.String(), err)
+	}
+	return img, err
+}
+
+func decodeSource(src imageSource) (image.Image, error) {
+	entry, err := fetchSource(src)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(entry.data)
+	if err == errSourceTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &sourceError{class: failureNotImage, msg: err.Error()}
+	}
+	return img, nil
+}
+
+// Gets the source from the source cache or loads it. The validators
+// of the upstream are stored with the bytes so expired source
+// revalidated instead of full download.
+func fetchSource(src imageSource) (*sourceEntry, error) {
+	// There is no sense to cache inline sources.
+	if src.data != nil {
+		return &sourceEntry{key: src.String(), data: src.data}, nil
+	}
+	key := src.String()
+	cached, fresh := sources.get(key)
+	if fresh {
+		return cached, nil
+	}
+	var o origin = urlOrigin
+	if src.origin != "" {
+		// The origin could be removed by reload of the config.
+		named, ok := currentSettings().origins[src.origin]
+		if !ok {
+			return nil, errSourceNotFound
+		}
+		o = named
+	}
+	entry, err := o.fetch(src.path, cached)
+	if err != nil {
+		return nil, err
+	}
+	if entry == cached {
+		sources.extend(key, currentSettings().config.SourceCachingDuration)
+		return cached, nil
+	}
+	entry.key = key
+	// Results rendered from the old version of the source should
+	// not be served anymore. Looking for them takes the scan of the
+	// whole cache so the request does not wait for it.
+	if cached != nil && !bytes.Equal(cached.data, entry.data) {
+		go deleteResults(key)
+	}
+	sources.set(entry, currentSettings().config.SourceCachingDuration)
+	return entry, nil
+}
+
+// Decodes the source in any of supported formats: JPEG, PNG or GIF.
+// The size is checked by the header before the pixels are allocated.
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPixels(cfg); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+func checkPixels(cfg image.Config) error {
+	if uint64(cfg.Width)*uint64(cfg.Height) > maxSourcePixels {
+		return errSourceTooLarge
+	}
+	return nil
+}
+
+// Reads one byte over the limit for detecting too large sources
+// without known size.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errSourceTooLarge
+	}
+	return data, nil
+}
@@ -4,41 +4,107 @@ import (
 	"github.com/coocood/freecache"
 
 	"flag"
+	"fmt"
 	"net/http"
+	"os"
 )
 
 const version = "0.1"
 
 const (
-	// For production services the size setting obviously should be
-	// move to config.
-	cacheSize = 300 * 1024 * 1024
+	// Could be changed in the config, see config.go.
+	defaultCacheSize = 300 * 1024 * 1024
+	// Originals are much larger than the results so they have own
+	// cache.
+	defaultSourceCacheSize = 200 * 1024 * 1024
+	// Only failure reasons stored there so it could be small.
+	failureCacheSize = 1024 * 1024
 )
 
 var (
-	hostPort string
-	cache    *freecache.Cache
+	hostPort   string
+	configPath string
+	adminToken string
+	cache      *freecache.Cache
+	sources    *sourceCache
+	failures   *freecache.Cache
 )
 
 func main() {
-	flag.StringVar(&hostPort, "listen-at", "localhost:8080", "listen for HTTP requests at host:port")
+	var printConfig bool
+	flag.StringVar(&configPath, "config", "", "path to the config file in TOML format")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	defineFlags(flag.CommandLine)
 	flag.Parse()
 
-	cache = freecache.NewCache(cacheSize)
+	cfg, err := loadConfig(configPath, flag.CommandLine)
+	var s *settings
+	if err == nil {
+		s, err = newSettings(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		os.Exit(1)
+	}
+	if printConfig {
+		if err = cfg.print(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "config: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	current.Store(s)
+	hostPort, adminToken = cfg.ListenAt, cfg.AdminToken
+	reloadOnSignal(configPath, flag.CommandLine)
 
+	cache = freecache.NewCache(cfg.CacheSize)
+	sources = newSourceCache(cfg.SourceCacheSize)
+	failures = freecache.NewCache(failureCacheSize)
+
+	// Own mux instead of the default one as packages could register
+	// debug handlers there.
+	mux := http.NewServeMux()
 	// Why we need "/" handler for the simple service? Beter to show
 	// version on requests to root page for understanding that service
 	// you have on this port. Getting the root page could be used by
 	// monitoring service for health checks for example.
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handleRootRequest(w, r)
 	})
 	// Move real handling to another function for keeping main() short
 	// and clean.
-	http.HandleFunc("/resize", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/resize", func(w http.ResponseWriter, r *http.Request) {
 		handleResizeRequest(w, r)
 	})
-	if err := http.ListenAndServe(hostPort, nil); err != nil {
+	// The same with options in the path for CDNs.
+	mux.HandleFunc(pathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		handlePathRequest(w, r)
+	})
+	// Metadata of the source without resizing.
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		handleInfoRequest(w, r)
+	})
+	mux.HandleFunc("/palette", func(w http.ResponseWriter, r *http.Request) {
+		handlePaletteRequest(w, r)
+	})
+	// Perceptual hashes for finding duplicates.
+	mux.HandleFunc("/phash", func(w http.ResponseWriter, r *http.Request) {
+		handlePHashRequest(w, r)
+	})
+	mux.HandleFunc("/compare", func(w http.ResponseWriter, r *http.Request) {
+		handleCompareRequest(w, r)
+	})
+	// Cache maintenance. Handlers check the admin token themselves.
+	mux.HandleFunc("/admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminCacheRequest(w, r)
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminStatsRequest(w, r)
+	})
+	mux.HandleFunc("/admin/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminMetricsRequest(w, r)
+	})
+	if err := http.ListenAndServe(hostPort, mux); err != nil {
 		panic(err)
 	}
 }
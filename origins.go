@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The place where the sources are stored. Origins are configured by
+// name and referenced in requests as `src=name:path` or
+// `origin=name&path=path`.
+type origin interface {
+	// Validates the path before anything loaded.
+	checkPath(path string) error
+	// Returns the source at the path. When `cached` is set it is
+	// returned itself if the source is not modified.
+	fetch(path string, cached *sourceEntry) (*sourceEntry, error)
+}
+
+// Origin configured by name. Besides the storage itself it keeps
+// the settings common for all types of the origins.
+type namedOrigin struct {
+	origin
+	// Prefixes of the paths allowed for loading, all paths are
+	// allowed when it is empty.
+	allowedPaths []string
+	// Transform options for requests which omit them.
+	defaults transformDefaults
+	// Placeholder for the sources failed to load, global fallback is
+	// used when it is not set.
+	fallback *fallbackImage
+}
+
+var errSourceNotFound = &sourceError{class: failureNotFound, msg: "source not found"}
+
+// Parses `name:path` value of the `src` parameter.
+func (s *settings) parseSource(value string) (imageSource, *namedOrigin, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return imageSource{}, nil, errors.New("`src` should be in form `origin:path`")
+	}
+	return s.resolveSource(parts[0], parts[1])
+}
+
+// Finds the origin by name and checks the path is allowed for it.
+func (s *settings) resolveSource(name, path string) (imageSource, *namedOrigin, error) {
+	o, ok := s.origins[name]
+	if !ok {
+		return imageSource{}, nil, fmt.Errorf("unknown origin %q", name)
+	}
+	if path == "" {
+		return imageSource{}, nil, errors.New("non empty path inside the origin is mandatory")
+	}
+	if err := o.checkPath(path); err != nil {
+		return imageSource{}, nil, err
+	}
+	return imageSource{origin: name, path: path}, o, nil
+}
+
+func (o *namedOrigin) checkPath(path string) error {
+	if len(o.allowedPaths) > 0 {
+		allowed := false
+		for _, prefix := range o.allowedPaths {
+			if strings.HasPrefix("/"+strings.TrimLeft(path, "/"), prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("path is not allowed for the origin")
+		}
+	}
+	return o.origin.checkPath(path)
+}
+
+// Makes the origins from their config.
+func setupOrigins(configs map[string]originConfig) (map[string]*namedOrigin, error) {
+	result := make(map[string]*namedOrigin, len(configs))
+	for name, cfg := range configs {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("origin name %q should be non empty and without `:`", name)
+		}
+		// Keys of inline sources start with `data:` and sources in
+		// the path form of requests are told from URLs by the scheme.
+		if name == "data" || name == "http" || name == "https" {
+			return nil, fmt.Errorf("origin name %q is reserved", name)
+		}
+		var (
+			o   origin
+			err error
+		)
+		switch cfg.Type {
+		case "http":
+			o, err = newHTTPOrigin(cfg)
+		case "local":
+			o, err = newLocalOrigin(cfg)
+		case "s3":
+			o, err = newS3Origin(cfg)
+		default:
+			err = fmt.Errorf("unknown type %q", cfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("origin %q: %s", name, err)
+		}
+		if err = parseTransformOptions(nil, cfg.Defaults, new(resizeParams)); err != nil {
+			return nil, fmt.Errorf("origin %q: defaults: %s", name, err)
+		}
+		named := &namedOrigin{origin: o, defaults: cfg.Defaults}
+		if cfg.Fallback != "" {
+			if named.fallback, err = newFallback(cfg.Fallback); err != nil {
+				return nil, fmt.Errorf("origin %q: fallback: %s", name, err)
+			}
+		}
+		for _, prefix := range cfg.AllowedPaths {
+			named.allowedPaths = append(named.allowedPaths, "/"+strings.TrimLeft(prefix, "/"))
+		}
+		result[name] = named
+	}
+	return result, nil
+}
+
+// Paths inside the origins could not go up with `..`.
+func checkRelativePath(path string) error {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return errors.New("`..` is not allowed in the path")
+		}
+	}
+	if strings.IndexByte(path, 0) >= 0 {
+		return errors.New("path contains zero byte")
+	}
+	return nil
+}
+
+// Directory on the local filesystem (NFS mounts are fine too). Paths
+// could not escape the root neither with `..` nor with symlinks.
+type localOrigin struct {
+	root    string
+	maxSize int64
+}
+
+// The root is resolved to absolute path without symlinks once so
+// resolved paths of the sources could be compared with it.
+func newLocalOrigin(cfg originConfig) (*localOrigin, error) {
+	root := cfg.Root
+	if root == "" {
+		return nil, errors.New("`root` is mandatory for local origin")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	return &localOrigin{root: root, maxSize: cfg.maxSize()}, nil
+}
+
+func (o *localOrigin) checkPath(path string) error {
+	return checkRelativePath(path)
+}
+
+// Validators are made of mtime and size of the file. Escapes by
+// symlinks reported as not found for not giving a clue what is
+// outside the root.
+func (o *localOrigin) fetch(path string, cached *sourceEntry) (*sourceEntry, error) {
+	if err := o.checkPath(path); err != nil {
+		return nil, err
+	}
+	fullPath, err := filepath.EvalSymlinks(filepath.Join(o.root, filepath.FromSlash(path)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSourceNotFound
+		}
+		return nil, err
+	}
+	if !strings.HasPrefix(fullPath, o.root+string(filepath.Separator)) {
+		return nil, errSourceNotFound
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSourceNotFound
+		}
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errSourceNotFound
+	}
+	if info.Size() > o.maxSize {
+		return nil, errSourceTooLarge
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	if cached != nil && cached.etag == etag {
+		return cached, nil
+	}
+	entry := &sourceEntry{
+		etag:         etag,
+		lastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if entry.data, err = readLimited(file, o.maxSize); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalOrigin_Validators(t *testing.T) {
+	o, err := newLocalOrigin(originConfig{Root: "testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := o.fetch("l_hires.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := o.fetch("l_hires.jpg", entry)
+
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entry.etag)
+	assert.NotEmpty(t, entry.lastModified)
+	assert.True(t, entry == again, "not modified file should return cached entry")
+}
+
+func TestLocalOrigin_RejectsDotDot(t *testing.T) {
+	o, err := newLocalOrigin(originConfig{Root: "testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, o.checkPath("../main.go"))
+	assert.Error(t, o.checkPath("a/../../main.go"))
+	assert.NoError(t, o.checkPath("a/..b/c.jpg"))
+}
+
+func TestLocalOrigin_RejectsSymlinkEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target, err := filepath.Abs("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(target, filepath.Join(root, "escape.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	o, err := newLocalOrigin(originConfig{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.fetch("escape.jpg", nil)
+
+	assert.Equal(t, errSourceNotFound, err)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+)
+
+// Settings of the placeholders that could be moved to the config.
+const (
+	// BlurHash is calculated on the copy downscaled to this size
+	// with the number of the components by X and Y.
+	blurHashSampleSize  = 32
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+	// LQIP is tiny JPEG with low quality.
+	lqipSize    = 20
+	lqipQuality = 30
+)
+
+// LQIP as it returned with `format=lqip`. The size is of the
+// requested image so the placeholder could be laid out before the
+// image is loaded.
+type lqipResult struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	DataURI string `json:"data_uri"`
+}
+
+// Makes low quality image placeholder: the image shrunk to tiny size
+// and encoded to JPEG inline in the JSON.
+func encodeLQIP(img image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, downscale(img, lqipSize), &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(lqipResult{
+		Width:   img.Bounds().Dx(),
+		Height:  img.Bounds().Dy(),
+		DataURI: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Calculates BlurHash of the image, see https://blurha.sh for the
+// algorithm.
+func encodeBlurHash(img image.Image, componentsX, componentsY int) string {
+	img = downscale(img, blurHashSampleSize)
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					factor[0] += basis * srgbToLinear(r>>8)
+					factor[1] += basis * srgbToLinear(g>>8)
+					factor[2] += basis * srgbToLinear(b>>8)
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	hash := new(strings.Builder)
+	encodeBase83(hash, (componentsX-1)+(componentsY-1)*9, 1)
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		encodeBase83(hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(hash, 0, 1)
+	}
+	dc := factors[0]
+	encodeBase83(hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		var quantised [3]int
+		for c, value := range factor {
+			quantised[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		encodeBase83(hash, quantised[0]*19*19+quantised[1]*19+quantised[2], 2)
+	}
+	return hash.String()
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(buf *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		buf.WriteByte(base83Chars[digit])
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	file, err := os.Open("testdata/l_hires.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checked against github.com/buckket/go-blurhash.
+	assert.Equal(t, "LMGGz:^kb^sA}@t7bHxF57D*Vsbb", encodeBlurHash(img, 4, 3))
+	assert.Equal(t, "00GGz:", encodeBlurHash(img, 1, 1))
+}
+
+func TestEncodeBlurHash_SolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	hash := encodeBlurHash(img, 4, 3)
+
+	// Size flag, maximum of AC, DC of 0xffffff and 11 AC components.
+	assert.Len(t, hash, 1+1+4+2*(4*3-1))
+	assert.Equal(t, "L", hash[:1])
+	assert.Equal(t, "TSUA", hash[2:6])
+}
+
+func TestEncodeLQIP(t *testing.T) {
+	data, err := encodeLQIP(image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result lqipResult
+	err = json.Unmarshal(data, &result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 300, result.Width)
+	assert.Equal(t, 200, result.Height)
+	assert.True(t, strings.HasPrefix(result.DataURI, "data:image/jpeg;base64,"))
+	assert.True(t, len(result.DataURI) < 1024, "placeholder should be tiny")
+}
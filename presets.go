@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Arguments of the request which are set by the presets.
+var presetArgs = []string{"width", "height", "mode", "format", "quality", "filter"}
+
+// Arguments of the effects applied besides the preset. With
+// `presets_only` they are refused too, otherwise any request could
+// add costly effects to the preset.
+var effectArgs = []string{
+	"trim", "trim_tolerance", "trim_color",
+	"blur", "unsharp",
+	"brightness", "contrast", "saturation", "gamma", "grayscale", "sepia",
+	"watermark", "wm_position", "wm_margin", "wm_opacity", "wm_scale",
+	"text", "text_font", "text_size", "text_color", "text_position",
+	"text_margin", "text_width", "text_shadow", "text_box",
+}
+
+// Returns the preset requested in the arguments. Mixing the preset
+// with own options is refused as it makes the results differ from
+// the preset silently.
+func (s *settings) findPreset(args url.Values) (transformDefaults, error) {
+	name := args.Get("preset")
+	preset, ok := s.presets[name]
+	if !ok {
+		return transformDefaults{}, fmt.Errorf("unknown preset %q", name)
+	}
+	for _, arg := range presetArgs {
+		if args.Get(arg) != "" {
+			return transformDefaults{}, fmt.Errorf("`%s` could not be combined with `preset`", arg)
+		}
+	}
+	if s.config.PresetsOnly {
+		for _, arg := range effectArgs {
+			if args.Get(arg) != "" {
+				return transformDefaults{}, fmt.Errorf("`%s` is not allowed with `presets_only`", arg)
+			}
+		}
+	}
+	return preset, nil
+}
+
+// Validates the presets from the config against its limits. Omitted
+// sides of the size are zero so the presets don't depend on the
+// defaults of origins.
+func setupPresets(cfg *config) (map[string]transformDefaults, error) {
+	result := make(map[string]transformDefaults, len(cfg.Presets))
+	for name, preset := range cfg.Presets {
+		if name == "" || strings.ContainsAny(name, ",/") {
+			return nil, fmt.Errorf("preset name %q should be non empty and without `,` and `/`", name)
+		}
+		// Presets are the options in the path form of the requests
+		// too so their names could not look like other options.
+		if _, _, err := parseOptionToken(name); err == nil {
+			return nil, fmt.Errorf("preset name %q is reserved", name)
+		}
+		var zero uint64
+		if preset.Width == nil {
+			preset.Width = &zero
+		}
+		if preset.Height == nil {
+			preset.Height = &zero
+		}
+		if err := cfg.checkSize(*preset.Width, *preset.Height); err != nil {
+			return nil, fmt.Errorf("preset %q: %s", name, err)
+		}
+		if err := parseTransformOptions(nil, preset, cfg.defaultParams()); err != nil {
+			return nil, fmt.Errorf("preset %q: %s", name, err)
+		}
+		result[name] = preset
+	}
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"net/url"
+	"testing"
+)
+
+func TestSetupPresets_Errors(t *testing.T) {
+	tooLarge, zero, valid := uint64(defaultMaxSize+1), uint64(0), uint64(defaultMinSize)
+	for name, preset := range map[string]transformDefaults{
+		"fit":   {},
+		"300x":  {},
+		"a,b":   {},
+		"large": {Width: &tooLarge},
+		"empty": {Width: &zero},
+		"zoom":  {Width: &valid, Mode: "zoom"},
+		"sinc":  {Width: &valid, Filter: "sinc"},
+	} {
+		cfg := defaultConfig()
+		cfg.Presets = map[string]transformDefaults{name: preset}
+		_, err := setupPresets(cfg)
+
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSetupPresets_ZeroSides(t *testing.T) {
+	width := uint64(defaultMinSize)
+	cfg := defaultConfig()
+	cfg.Presets = map[string]transformDefaults{"narrow": {Width: &width}}
+	result, err := setupPresets(cfg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), *result["narrow"].Height)
+}
+
+func TestParseArgs_PresetSameAsOptions(t *testing.T) {
+	fromPreset, err := parseArgs(url.Values{"url": {goodImageURL}, "preset": {"card"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromOptions, err := parseArgs(url.Values{
+		"url": {goodImageURL}, "width": {"64"}, "height": {"0"}, "mode": {"fit"}, "format": {"png"},
+	}, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fromOptions, fromPreset)
+	assert.Equal(t, formatCacheKey(fromOptions), formatCacheKey(fromPreset))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/golang/freetype/truetype"
+
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Settings made from the config which could be reloaded without
+// restart. They are swapped at once so each request sees either old
+// or new settings but not the mix of them. Listen address, admin
+// token and cache sizes are used at startup only.
+type settings struct {
+	config  *config
+	origins map[string]*namedOrigin
+	presets map[string]transformDefaults
+	// Overlays for watermarks decoded once.
+	watermarks map[string]*watermarkImage
+	// Fonts for the captions parsed once.
+	fonts map[string]*truetype.Font
+	// Global fallback for sources without own one.
+	fallback *fallbackImage
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(&settings{
+		config:  defaultConfig(),
+		origins: make(map[string]*namedOrigin),
+		presets: make(map[string]transformDefaults),
+	})
+}
+
+func currentSettings() *settings {
+	return current.Load().(*settings)
+}
+
+// Makes the settings from the config. Nothing is changed in the
+// running service so invalid config could be just dropped.
+func newSettings(cfg *config) (*settings, error) {
+	var (
+		s   = &settings{config: cfg}
+		err error
+	)
+	if cfg.Fallback != "" {
+		if s.fallback, err = newFallback(cfg.Fallback); err != nil {
+			return nil, fmt.Errorf("fallback: %s", err)
+		}
+	}
+	if s.origins, err = setupOrigins(cfg.Origins); err != nil {
+		return nil, err
+	}
+	if s.presets, err = setupPresets(cfg); err != nil {
+		return nil, err
+	}
+	if s.watermarks, err = setupWatermarks(cfg.Watermarks); err != nil {
+		return nil, err
+	}
+	if s.fonts, err = setupFonts(cfg.Fonts); err != nil {
+		return nil, err
+	}
+	if cfg.PresetsOnly && len(s.presets) == 0 {
+		return nil, errors.New("`presets_only` is set but there are no presets")
+	}
+	return s, nil
+}
+
+// Reloads the config on SIGHUP. The flags and the environment are
+// applied again so they still override the file. The signal is
+// handled since the return, the returned function stops handling.
+func reloadOnSignal(path string, flags *flag.FlagSet) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-done:
+				return
+			}
+			if err := reloadConfig(path, flags); err != nil {
+				log.Printf("config reload failed, old config is kept: %s", err)
+				continue
+			}
+			log.Printf("config reloaded")
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+func reloadConfig(path string, flags *flag.FlagSet) error {
+	cfg, err := loadConfig(path, flags)
+	if err != nil {
+		return err
+	}
+	s, err := newSettings(cfg)
+	if err != nil {
+		return err
+	}
+	old := currentSettings().config
+	if cfg.ListenAt != old.ListenAt || cfg.AdminToken != old.AdminToken || cfg.CacheSize != old.CacheSize ||
+		cfg.SourceCacheSize != old.SourceCacheSize {
+		log.Printf("config: changes of listen_at, admin_token, cache_size and source_cache_size need restart")
+	}
+	current.Store(s)
+	return nil
+}
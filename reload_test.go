@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"flag"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig_SwapsSettings(t *testing.T) {
+	path := writeTestConfig(t, "jpeg_quality = 50\n[presets]\nsmall = { width = 40 }\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	old := currentSettings()
+	defer current.Store(old)
+	err := reloadConfig(path, flag.NewFlagSet("test", flag.ContinueOnError))
+	s := currentSettings()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 50, s.config.JPEGQuality)
+	assert.Contains(t, s.presets, "small")
+	assert.Equal(t, defaultJPEGQuality, old.config.JPEGQuality)
+}
+
+func TestReloadConfig_KeepsOldOnError(t *testing.T) {
+	path := writeTestConfig(t, "presets_only = true\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	old := currentSettings()
+	defer current.Store(old)
+	err := reloadConfig(path, flag.NewFlagSet("test", flag.ContinueOnError))
+
+	assert.Error(t, err)
+	assert.True(t, old == currentSettings(), "settings should not change on invalid config")
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	path := writeTestConfig(t, "max_size = 4000\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	old := currentSettings()
+	defer current.Store(old)
+	stop := reloadOnSignal(path, flag.NewFlagSet("test", flag.ContinueOnError))
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if currentSettings() != old {
+			break
+		}
+	}
+
+	assert.Equal(t, uint64(4000), currentSettings().config.MaxSize)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Flaky upstreams are retried with exponential backoff and jitter.
+// The hosts which are down anyway are not touched for a while by
+// circuit breaker, requests to them fail fast.
+const (
+	maxFetchRetries     = 2
+	retryBaseDelay      = 50 * time.Millisecond
+	retryMaxDelay       = 2 * time.Second
+	breakerThreshold    = 5
+	breakerOpenDuration = 30 * time.Second
+	// Hosts come from the requests so the number of the breakers is
+	// limited. Without a breaker the host is just not protected.
+	maxBreakers = 1024
+)
+
+// Breakers by hosts of the upstreams. Only the hosts which failed
+// recently have them, success removes the breaker.
+var breakers = struct {
+	sync.Mutex
+	hosts map[string]*circuitBreaker
+}{hosts: make(map[string]*circuitBreaker)}
+
+// States of the breakers by hosts as they shown by admin API.
+func breakerStates() map[string]string {
+	breakers.Lock()
+	defer breakers.Unlock()
+	states := make(map[string]string, len(breakers.hosts))
+	for host, breaker := range breakers.hosts {
+		states[host] = breaker.currentState().String()
+	}
+	return states
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker opens after `breakerThreshold` failures in a row. When it
+// is open for `breakerOpenDuration` the single probe request is let
+// through, its result closes the breaker or opens it again.
+type circuitBreaker struct {
+	sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	failedAt time.Time
+}
+
+// Returns the breaker of the host or nil when the host had no
+// failures recently.
+func findBreaker(host string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	return breakers.hosts[host]
+}
+
+// Records the result of the request to the host. The breaker is made
+// on the first failure and dropped on success as it has nothing to
+// remember then.
+func recordResult(host string, success bool) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	breaker, ok := breakers.hosts[host]
+	if success {
+		if ok {
+			breaker.record(true)
+			delete(breakers.hosts, host)
+		}
+		return
+	}
+	if !ok {
+		if len(breakers.hosts) >= maxBreakers {
+			pruneBreakers()
+		}
+		if len(breakers.hosts) >= maxBreakers {
+			return
+		}
+		breaker = new(circuitBreaker)
+		breakers.hosts[host] = breaker
+	}
+	breaker.record(false)
+}
+
+// Drops the closed breakers without failures for a while. Called
+// with the breakers locked.
+func pruneBreakers() {
+	for host, breaker := range breakers.hosts {
+		if breaker.idle() {
+			delete(breakers.hosts, host)
+		}
+	}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < breakerOpenDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// The probe is in flight.
+		return false
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.failedAt = time.Now()
+	if b.state == breakerHalfOpen || b.failures >= breakerThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) idle() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state == breakerClosed && time.Since(b.failedAt) > breakerOpenDuration
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// Makes the request to the upstream with retries on connection
+// errors and 5xx/429 responses. Only idempotent requests are retried
+// and timeouts are not because they are slow anyway. When all the
+// tries failed the last response or error is returned.
+func doWithRetries(client *http.Client, req *http.Request) (*http.Response, error) {
+	if breaker := findBreaker(req.URL.Host); breaker != nil && !breaker.allow() {
+		return nil, fmt.Errorf("upstream %s is unavailable, circuit breaker is open", req.URL.Host)
+	}
+	idempotent := req.Method == "GET" || req.Method == "HEAD"
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; ; attempt++ {
+		resp, err = client.Do(req)
+		if !idempotent || attempt == maxFetchRetries || !isRetryable(resp, err) {
+			break
+		}
+		delay := backoffDelay(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+		}
+		// Upstream asked to wait too long, better to fail now.
+		if delay > retryMaxDelay {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(delay)
+	}
+	recordResult(req.URL.Host, err == nil && !isUpstreamFailure(resp.StatusCode))
+	return resp, err
+}
+
+// Errors of the request itself like unsupported scheme are not
+// retried, only network errors are.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		netErr, ok := err.(net.Error)
+		return ok && !netErr.Timeout()
+	}
+	return isUpstreamFailure(resp.StatusCode)
+}
+
+func isUpstreamFailure(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// Exponential backoff with jitter, so retries of many clients don't
+// come at the same time.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Parses Retry-After header which is either seconds or HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Origin which responds with the status for the first `failures`
+// requests and then succeeds. It counts all the requests.
+func newFlakyOrigin(status, failures int, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *requests <= failures {
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestDoWithRetries_RecoversFromServerErrors(t *testing.T) {
+	requests := 0
+	origin := newFlakyOrigin(http.StatusBadGateway, maxFetchRetries, &requests)
+	defer origin.Close()
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	resp, err := doWithRetries(http.DefaultClient, req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, maxFetchRetries+1, requests)
+}
+
+func TestDoWithRetries_HonoursRetryAfter(t *testing.T) {
+	requests := 0
+	origin := newFlakyOrigin(http.StatusTooManyRequests, 1, &requests)
+	defer origin.Close()
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	started := time.Now()
+	resp, err := doWithRetries(http.DefaultClient, req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(started) >= time.Second, "should wait as Retry-After asked")
+}
+
+func TestDoWithRetries_NoRetriesForClientErrors(t *testing.T) {
+	requests := 0
+	origin := newFlakyOrigin(http.StatusForbidden, 10, &requests)
+	defer origin.Close()
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	resp, err := doWithRetries(http.DefaultClient, req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 1, requests)
+}
+
+func TestDoWithRetries_CircuitBreakerOpens(t *testing.T) {
+	requests := 0
+	origin := newFlakyOrigin(http.StatusServiceUnavailable, 1000, &requests)
+	defer origin.Close()
+	for i := 0; i < breakerThreshold; i++ {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		doWithRetries(http.DefaultClient, req)
+	}
+	requestsBefore := requests
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	_, err := doWithRetries(http.DefaultClient, req)
+
+	assert.Error(t, err)
+	assert.Equal(t, requestsBefore, requests, "open breaker should not let requests through")
+	assert.Equal(t, breakerOpen, findBreaker(req.URL.Host).currentState())
+}
+
+func TestDoWithRetries_NoBreakerForHealthyHosts(t *testing.T) {
+	requests := 0
+	origin := newFlakyOrigin(http.StatusBadGateway, 1, &requests)
+	defer origin.Close()
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	doWithRetries(http.DefaultClient, req)
+
+	// The failure is followed by success of the retry.
+	assert.Nil(t, findBreaker(req.URL.Host))
+	assert.Nil(t, findBreaker("never-requested.test"))
+}
+
+func TestRecordResult_LimitsBreakers(t *testing.T) {
+	defer func() {
+		breakers.Lock()
+		breakers.hosts = make(map[string]*circuitBreaker)
+		breakers.Unlock()
+	}()
+	for i := 0; i < maxBreakers+10; i++ {
+		recordResult(fmt.Sprintf("host%d.test", i), false)
+	}
+	breakers.Lock()
+	count := len(breakers.hosts)
+	breakers.hosts["host0.test"].failedAt = time.Now().Add(-2 * breakerOpenDuration)
+	breakers.Unlock()
+	recordResult("fresh.test", false)
+
+	assert.Equal(t, maxBreakers, count)
+	assert.NotNil(t, findBreaker("fresh.test"))
+	assert.Nil(t, findBreaker("host0.test"))
+}
+
+func TestBreakerStates(t *testing.T) {
+	defer recordResult("states.test", true)
+	for i := 0; i < breakerThreshold; i++ {
+		recordResult("states.test", false)
+	}
+
+	assert.Equal(t, "open", breakerStates()["states.test"])
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	breaker := &circuitBreaker{state: breakerOpen, openedAt: time.Now().Add(-breakerOpenDuration)}
+	probeAllowed := breaker.allow()
+	secondAllowed := breaker.allow()
+	breaker.record(true)
+
+	assert.True(t, probeAllowed)
+	assert.False(t, secondAllowed)
+	assert.Equal(t, breakerClosed, breaker.currentState())
+}
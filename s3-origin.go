@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hash of the empty payload, all requests to S3 are GETs and HEADs
+// without body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Bucket in S3-compatible object storage. Objects are loaded with
+// requests signed by AWS Signature Version 4. Path-style addressing
+// (`endpoint/bucket/key`) is for the storages like MinIO which have
+// no virtual hosts for buckets.
+type s3Origin struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+	maxSize   int64
+}
+
+func newS3Origin(cfg originConfig) (*s3Origin, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("`endpoint` and `bucket` are mandatory for s3 origin")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("`access_key` and `secret_key` are mandatory for s3 origin")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, errors.New("`endpoint` should be absolute HTTP(S) URL")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Origin{
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		region:    region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		pathStyle: cfg.PathStyle,
+		client:    cfg.client(),
+		maxSize:   cfg.maxSize(),
+	}, nil
+}
+
+func (o *s3Origin) checkPath(path string) error {
+	if strings.Trim(path, "/") == "" {
+		return errors.New("object key is empty")
+	}
+	return nil
+}
+
+// Revalidation is made with HeadObject: the object is not loaded
+// again while its ETag is the same.
+func (o *s3Origin) fetch(path string, cached *sourceEntry) (*sourceEntry, error) {
+	if cached != nil && cached.etag != "" {
+		resp, err := o.do("HEAD", path)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("Etag") == cached.etag {
+			return cached, nil
+		}
+	}
+	resp, err := o.do("GET", path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errSourceNotFound
+	default:
+		return nil, fmt.Errorf("object storage returned %s", resp.Status)
+	}
+	if resp.ContentLength > o.maxSize {
+		return nil, errSourceTooLarge
+	}
+	entry := &sourceEntry{
+		etag:         resp.Header.Get("Etag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if entry.data, err = readLimited(resp.Body, o.maxSize); err != nil {
+		return nil, classifyNetError(err)
+	}
+	return entry, nil
+}
+
+func (o *s3Origin) do(method, key string) (*http.Response, error) {
+	req, err := http.NewRequest(method, o.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, o.accessKey, o.secretKey, o.region, time.Now())
+	resp, err := doWithRetries(o.client, req)
+	if err != nil {
+		return nil, classifyNetError(err)
+	}
+	return resp, nil
+}
+
+func (o *s3Origin) objectURL(key string) string {
+	u := *o.endpoint
+	key = strings.TrimLeft(key, "/")
+	if o.pathStyle {
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + o.bucket + "/" + key
+	} else {
+		u.Host = o.bucket + "." + u.Host
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return u.String()
+}
+
+// Signs the request to S3 with AWS Signature Version 4. All the
+// headers set at the moment are signed.
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(args url.Values) string {
+	pairs := make([]string, 0, len(args))
+	for name, values := range args {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Escapes the path as S3 expects it: each segment separately and
+// only unreserved characters of RFC 3986 are left as is.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
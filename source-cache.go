@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Fetched source images kept apart from the rendered results so
+// requests for new sizes of a recently seen image skip the
+// network. Freecache refuses values larger than 1/1024 of its size
+// and the originals are often megabytes so there is simple LRU
+// bounded by total size of the stored bytes.
+type sourceCache struct {
+	sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+// Raw bytes of the source with validators got from the upstream.
+type sourceEntry struct {
+	key          string
+	data         []byte
+	etag         string
+	lastModified string
+	expireAt     time.Time
+}
+
+func newSourceCache(maxSize int) *sourceCache {
+	return &sourceCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Returns the source for the key and whether it is still
+// fresh. Expired sources are kept until evicted because their
+// validators allow cheap revalidation with the upstream.
+func (c *sourceCache) get(key string) (src *sourceEntry, fresh bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	src = elem.Value.(*sourceEntry)
+	return src, time.Now().Before(src.expireAt)
+}
+
+// Prolongs life of the source when upstream confirmed it is not
+// modified.
+func (c *sourceCache) extend(key string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*sourceEntry).expireAt = time.Now().Add(ttl)
+	}
+}
+
+// Stores the source for `ttl` and evicts least recently used
+// entries until all fits the size limit. Sources larger than the
+// whole cache are just skipped.
+func (c *sourceCache) set(src *sourceEntry, ttl time.Duration) {
+	if len(src.data) > c.maxSize {
+		return
+	}
+	src.expireAt = time.Now().Add(ttl)
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[src.key]; ok {
+		c.remove(elem)
+	}
+	c.items[src.key] = c.order.PushFront(src)
+	c.size += len(src.data)
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *sourceCache) del(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Returns number of the stored sources and their total size.
+func (c *sourceCache) stats() (entries, size int) {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.items), c.size
+}
+
+// Should be called under lock.
+func (c *sourceCache) remove(elem *list.Element) {
+	src := c.order.Remove(elem).(*sourceEntry)
+	delete(c.items, src.key)
+	c.size -= len(src.data)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+	"time"
+)
+
+func TestSourceCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newSourceCache(10)
+	c.set(&sourceEntry{key: "a", data: make([]byte, 4)}, time.Minute)
+	c.set(&sourceEntry{key: "b", data: make([]byte, 4)}, time.Minute)
+	c.get("a")
+	c.set(&sourceEntry{key: "c", data: make([]byte, 4)}, time.Minute)
+	a, _ := c.get("a")
+	b, _ := c.get("b")
+	cc, _ := c.get("c")
+
+	assert.NotNil(t, a)
+	assert.Nil(t, b)
+	assert.NotNil(t, cc)
+	assert.Equal(t, 8, c.size)
+}
+
+func TestSourceCache_KeepsExpiredForRevalidation(t *testing.T) {
+	c := newSourceCache(10)
+	c.set(&sourceEntry{key: "a", data: make([]byte, 4)}, -time.Second)
+	src, fresh := c.get("a")
+
+	assert.NotNil(t, src)
+	assert.False(t, fresh)
+	assert.Equal(t, 4, c.size)
+}
+
+func TestSourceCache_Extend(t *testing.T) {
+	c := newSourceCache(10)
+	c.set(&sourceEntry{key: "a", data: make([]byte, 4)}, -time.Second)
+	c.extend("a", time.Minute)
+	_, fresh := c.get("a")
+
+	assert.True(t, fresh)
+}
+
+func TestSourceCache_SkipsTooLarge(t *testing.T) {
+	c := newSourceCache(10)
+	c.set(&sourceEntry{key: "a", data: make([]byte, 11)}, time.Minute)
+	src, _ := c.get("a")
+
+	assert.Nil(t, src)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Failed loads of the sources are remembered for a short time so
+// retries don't hammer the upstream. Only failures that likely
+// repeat on the next try are cached. Other network errors and 5xx
+// responses are transient and not cached at all.
+type failureClass byte
+
+const (
+	failureNotFound failureClass = iota + 1
+	failureNotImage
+	failureTooLarge
+	failureTimeout
+)
+
+func (c failureClass) String() string {
+	switch c {
+	case failureNotFound:
+		return "not_found"
+	case failureNotImage:
+		return "not_image"
+	case failureTooLarge:
+		return "too_large"
+	case failureTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// Failure of the source loading that worth to be remembered.
+type sourceError struct {
+	class failureClass
+	msg   string
+}
+
+func (e *sourceError) Error() string {
+	return e.msg
+}
+
+// Timeouts could be transient so they remembered for much shorter
+// time than other failures.
+func (c failureClass) cachingDuration() time.Duration {
+	cfg := currentSettings().config
+	if c == failureTimeout {
+		return cfg.TimeoutCachingDuration
+	}
+	return cfg.FailureCachingDuration
+}
+
+// Converts timeouts of the HTTP client to the cacheable failure.
+func classifyNetError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &sourceError{class: failureTimeout, msg: err.Error()}
+	}
+	return err
+}
+
+// Returns the remembered failure for URL if any.
+func cachedFailure(url string) error {
+	data, err := failures.Get([]byte(url))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return &sourceError{class: failureClass(data[0]), msg: string(data[1:])}
+}
+
+// Remembers the failure if it is worth it. The value keeps the class
+// of the failure in the first byte and the message after it.
+func rememberFailure(url string, err error) {
+	srcErr, ok := err.(*sourceError)
+	if !ok {
+		return
+	}
+	data := append([]byte{byte(srcErr.class)}, srcErr.msg...)
+	failures.Set([]byte(url), data, int(srcErr.class.cachingDuration().Seconds()))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Limit of the caption in characters. The text is a part of the
+	// cache key and the URL so it should be short anyway.
+	maxTextLength       = 200
+	defaultTextSize     = 24
+	minTextSize         = 6
+	maxTextSize         = 256
+	defaultTextMargin   = 16
+	defaultTextPosition = "bottom"
+)
+
+var defaultTextColor = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+
+// Caption of the request. Size is in pixels, width is the limit of
+// the lines, zero means the width of the result without the margins.
+// Shadow and box are optional.
+type textParams struct {
+	text     string
+	fontName string
+	font     *truetype.Font
+	size     int
+	color    color.NRGBA
+	position string
+	margin   int
+	width    int
+	shadow   *color.NRGBA
+	box      *color.NRGBA
+}
+
+// Parses the TrueType fonts from the config.
+func setupFonts(paths map[string]string) (map[string]*truetype.Font, error) {
+	result := make(map[string]*truetype.Font, len(paths))
+	for name, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("font %q: %s", name, err)
+		}
+		if result[name], err = truetype.Parse(data); err != nil {
+			return nil, fmt.Errorf("font %q: %s", name, err)
+		}
+	}
+	return result, nil
+}
+
+// Parses `text` parameter with `text_font`, `text_size`,
+// `text_color`, `text_position`, `text_margin`, `text_width`,
+// `text_shadow` and `text_box` options. The font could be omitted
+// when there is the only one in the config.
+func (s *settings) parseText(args url.Values) (*textParams, error) {
+	text := args.Get("text")
+	if text == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return nil, fmt.Errorf("`text` should be at most %d characters", maxTextLength)
+	}
+	p := &textParams{
+		text:     text,
+		fontName: args.Get("text_font"),
+		size:     defaultTextSize,
+		color:    defaultTextColor,
+		position: defaultTextPosition,
+		margin:   defaultTextMargin,
+	}
+	if p.fontName == "" {
+		if len(s.fonts) != 1 {
+			return nil, errors.New("`text_font` is required when there is not exactly one font")
+		}
+		for name := range s.fonts {
+			p.fontName = name
+		}
+	}
+	var ok bool
+	if p.font, ok = s.fonts[p.fontName]; !ok {
+		return nil, fmt.Errorf("unknown font %q", p.fontName)
+	}
+	var err error
+	if args.Get("text_size") != "" {
+		if p.size, err = strconv.Atoi(args.Get("text_size")); err != nil {
+			return nil, errors.New("`text_size` should be a number")
+		}
+		if p.size < minTextSize || p.size > maxTextSize {
+			return nil, fmt.Errorf("`text_size` should be in range %d..%d", minTextSize, maxTextSize)
+		}
+	}
+	if args.Get("text_color") != "" {
+		if p.color, err = parseColor(args.Get("text_color")); err != nil {
+			return nil, fmt.Errorf("`text_color`: %s", err)
+		}
+	}
+	if args.Get("text_position") != "" {
+		p.position = args.Get("text_position")
+		if _, ok := watermarkPositions[p.position]; !ok {
+			return nil, fmt.Errorf("unknown text position %q", p.position)
+		}
+	}
+	if args.Get("text_margin") != "" {
+		if p.margin, err = strconv.Atoi(args.Get("text_margin")); err != nil || p.margin < 0 || p.margin > defaultMaxSize {
+			return nil, fmt.Errorf("`text_margin` should be in range 0..%d", defaultMaxSize)
+		}
+	}
+	if args.Get("text_width") != "" {
+		if p.width, err = strconv.Atoi(args.Get("text_width")); err != nil || p.width < 0 || p.width > defaultMaxSize {
+			return nil, fmt.Errorf("`text_width` should be in range 0..%d", defaultMaxSize)
+		}
+	}
+	for _, opt := range []struct {
+		name string
+		dst  **color.NRGBA
+	}{{"text_shadow", &p.shadow}, {"text_box", &p.box}} {
+		if args.Get(opt.name) == "" {
+			continue
+		}
+		c, err := parseColor(args.Get(opt.name))
+		if err != nil {
+			return nil, fmt.Errorf("`%s`: %s", opt.name, err)
+		}
+		*opt.dst = &c
+	}
+	return p, nil
+}
+
+// Parses the colour in hex form `rrggbb` or `rrggbbaa`, leading `#`
+// is optional.
+func parseColor(value string) (color.NRGBA, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || len(b) != 3 && len(b) != 4 {
+		return color.NRGBA{}, fmt.Errorf("colour %q should be in form rrggbb or rrggbbaa", value)
+	}
+	c := color.NRGBA{b[0], b[1], b[2], 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+func formatColor(c *color.NRGBA) string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// Part of the cache key. The text is quoted so it could not be
+// confused with the options.
+func (p *textParams) String() string {
+	return fmt.Sprintf("%q,%s,%d,%s,%s,%d,%d,%s,%s", p.text, p.fontName, p.size, formatColor(&p.color),
+		p.position, p.margin, p.width, formatColor(p.shadow), formatColor(p.box))
+}
+
+// Draws the caption over the image. Lines are wrapped by words to
+// fit the width and aligned to the side of the position. Text which
+// does not fit the height is cut.
+func applyText(img image.Image, p *textParams) image.Image {
+	face := truetype.NewFace(p.font, &truetype.Options{Size: float64(p.size), DPI: 72, Hinting: font.HintingFull})
+	defer face.Close()
+	bounds := img.Bounds()
+	padding := 0
+	if p.box != nil {
+		padding = p.size / 4
+	}
+	maxWidth := bounds.Dx() - 2*p.margin - 2*padding
+	if p.width > 0 && p.width < maxWidth {
+		maxWidth = p.width
+	}
+	if maxWidth <= 0 {
+		return img
+	}
+	lines := wrapText(face, p.text, fixed.I(maxWidth))
+	widths := make([]int, len(lines))
+	textWidth := 0
+	for i, line := range lines {
+		widths[i] = font.MeasureString(face, line).Ceil()
+		if widths[i] > textWidth {
+			textWidth = widths[i]
+		}
+	}
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	textHeight := lineHeight * len(lines)
+	width, height := textWidth+2*padding, textHeight+2*padding
+
+	// The same placement as of the watermarks.
+	pos := watermarkPositions[p.position]
+	x := bounds.Min.X + p.margin + (pos.X+1)*(bounds.Dx()-2*p.margin-width)/2
+	y := bounds.Min.Y + p.margin + (pos.Y+1)*(bounds.Dy()-2*p.margin-height)/2
+
+	dst := toDrawable(img)
+	if p.box != nil {
+		draw.Draw(dst, image.Rect(x, y, x+width, y+height), image.NewUniform(p.box), image.Point{}, draw.Over)
+	}
+	drawLines := func(c color.Color, dx, dy int) {
+		d := &font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face}
+		for i, line := range lines {
+			lineX := x + padding + (pos.X+1)*(textWidth-widths[i])/2
+			d.Dot = fixed.P(lineX+dx, y+padding+i*lineHeight+dy)
+			d.Dot.Y += metrics.Ascent
+			d.DrawString(line)
+		}
+	}
+	if p.shadow != nil {
+		offset := p.size / 16
+		if offset < 1 {
+			offset = 1
+		}
+		drawLines(p.shadow, offset, offset)
+	}
+	drawLines(p.color, 0, 0)
+	return dst
+}
+
+// Splits the text to the lines not wider than maxWidth. Explicit
+// line breaks are kept, the words longer than a line are broken by
+// characters.
+func wrapText(face font.Face, text string, maxWidth fixed.Int26_6) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for font.MeasureString(face, word) > maxWidth && utf8.RuneCountInString(word) > 1 {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				n := fitPrefix(face, word, maxWidth)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			switch {
+			case line == "":
+				line = word
+			case font.MeasureString(face, line+" "+word) <= maxWidth:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Returns the length in bytes of the longest prefix of the word
+// which fits the width, at least one character.
+func fitPrefix(face font.Face, word string, maxWidth fixed.Int26_6) int {
+	_, n := utf8.DecodeRuneInString(word)
+	for i := range word {
+		if i <= n {
+			continue
+		}
+		if font.MeasureString(face, word[:i]) > maxWidth {
+			break
+		}
+		n = i
+	}
+	return n
+}
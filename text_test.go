@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/golang/freetype/truetype"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+
+	"image/color"
+	"net/url"
+	"testing"
+)
+
+func loadTestFont(t *testing.T) *truetype.Font {
+	fonts, err := setupFonts(map[string]string{"regular": "testdata/goregular.ttf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fonts["regular"]
+}
+
+func TestWrapText(t *testing.T) {
+	face := truetype.NewFace(loadTestFont(t), &truetype.Options{Size: 20})
+	maxWidth := font.MeasureString(face, "the quick")
+	if w := font.MeasureString(face, "brown fox"); w > maxWidth {
+		maxWidth = w
+	}
+	lines := wrapText(face, "the quick brown fox\njumps", maxWidth)
+
+	assert.Equal(t, []string{"the quick", "brown fox", "jumps"}, lines)
+	for _, line := range wrapText(face, "supercalifragilistic", maxWidth) {
+		assert.True(t, font.MeasureString(face, line) <= maxWidth, line)
+	}
+	assert.Equal(t, []string{"W"}, wrapText(face, "W", fixed.I(1)))
+}
+
+func TestParseColor(t *testing.T) {
+	c, err := parseColor("#ff8000")
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0xff, 0x80, 0, 0xff}, c)
+	c, err = parseColor("00000080")
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0, 0, 0, 0x80}, c)
+	for _, value := range []string{"fff", "red", "ff00ff0000"} {
+		_, err = parseColor(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseText_Errors(t *testing.T) {
+	s := &settings{fonts: map[string]*truetype.Font{"regular": loadTestFont(t)}}
+	for _, query := range []string{
+		"text=a&text_font=bold",
+		"text=a&text_size=2",
+		"text=a&text_color=white",
+		"text=a&text_position=middle",
+		"text=a&text_margin=-1",
+		"text=a&text_box=0",
+	} {
+		args, _ := url.ParseQuery(query)
+		_, err := s.parseText(args)
+		assert.Error(t, err, query)
+	}
+	args, _ := url.ParseQuery("text=a&text_shadow=000000")
+	p, err := s.parseText(args)
+	assert.NoError(t, err)
+	assert.Equal(t, "regular", p.fontName)
+	assert.Equal(t, `"a",regular,24,ffffffff,bottom,16,0,000000ff,`, p.String())
+}
+
+func TestApplyText(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 0xff}
+	p := &textParams{text: "Hello", font: loadTestFont(t), size: 20, color: black, position: "bottom-right", margin: 10}
+	img := applyText(newSolidImage(200, 100, color.White), p)
+
+	dark := 0
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r < 0x8000 {
+				dark++
+				// The text is inside the margins at the bottom-right.
+				assert.True(t, x >= 100 && x < 190 && y >= 60 && y < 90, "%d,%d", x, y)
+			}
+		}
+	}
+	assert.True(t, dark > 0)
+}
+
+func TestApplyText_Box(t *testing.T) {
+	green := color.NRGBA{0, 0xff, 0, 0xff}
+	p := &textParams{text: "Hi", font: loadTestFont(t), size: 20, color: defaultTextColor, position: "top-left", box: &green}
+	img := applyText(newSolidImage(100, 100, color.Black), p)
+
+	assert.Equal(t, color.RGBA{0, 0xff, 0, 0xff}, img.At(1, 1))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(90, 90))
+}
+
+func TestApplyText_KeepsSource(t *testing.T) {
+	src := newSolidImage(100, 40, color.White)
+	p := &textParams{text: "Hello", font: loadTestFont(t), size: 20, color: color.NRGBA{0, 0, 0, 0xff}, position: "center"}
+	applyText(src, p)
+
+	for x := 0; x < 100; x++ {
+		assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, src.At(x, 20))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strconv"
+)
+
+// Interpolation functions by their names in the requests.
+var resizeFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// Modes of fitting the image into requested size:
+//
+//	stretch  exactly requested size, aspect ratio is not kept
+//	fit      whole image inside the size, aspect ratio is kept
+//	fill     covers the size and cropped by center, aspect ratio is kept
+var resizeModes = map[string]bool{"stretch": true, "fit": true, "fill": true}
+
+// Formats of the results. WebP has no encoder in the standard
+// library so it is refused explicitly. BlurHash and LQIP are the
+// placeholders of the image, see placeholders.go.
+var outputFormats = map[string]bool{"jpeg": true, "png": true, "gif": true, "blurhash": true, "lqip": true}
+
+// Content type of the result in the format.
+func contentType(format string) string {
+	switch format {
+	case "blurhash":
+		return "text/plain; charset=utf-8"
+	case "lqip":
+		return "application/json"
+	}
+	return "image/" + format
+}
+
+// Parses the options of the transformation from the request
+// arguments. Omitted options are taken from the defaults of the
+// origin if they are set there.
+func parseTransformOptions(args url.Values, defaults transformDefaults, params *resizeParams) error {
+	mode, format, filter := args.Get("mode"), args.Get("format"), args.Get("filter")
+	if mode == "" && defaults.Mode != "" {
+		mode = defaults.Mode
+	}
+	if format == "" && defaults.Format != "" {
+		format = defaults.Format
+	}
+	if filter == "" && defaults.Filter != "" {
+		filter = defaults.Filter
+	}
+	if mode != "" {
+		if !resizeModes[mode] {
+			return fmt.Errorf("unknown mode %q", mode)
+		}
+		params.mode = mode
+	}
+	if format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if format == "webp" {
+			return errors.New("webp format is not supported")
+		}
+		if !outputFormats[format] {
+			return fmt.Errorf("unknown format %q", format)
+		}
+		params.format = format
+	}
+	if filter != "" {
+		if _, ok := resizeFilters[filter]; !ok {
+			return fmt.Errorf("unknown filter %q", filter)
+		}
+		params.filter = filter
+	}
+	switch {
+	case args.Get("quality") != "":
+		quality, err := strconv.Atoi(args.Get("quality"))
+		if err != nil || quality < 1 || quality > 100 {
+			return errors.New("quality value should be in range 1..100")
+		}
+		params.quality = quality
+	case defaults.Quality != nil:
+		params.quality = *defaults.Quality
+	}
+	return nil
+}
+
+// Transforms the source image by the parameters and encodes the
+// result.
+func processImage(srcImage image.Image, params *resizeParams) ([]byte, error) {
+	if params.trim != nil {
+		srcImage = trimBorders(srcImage, params.trim)
+	}
+	img := transformImage(srcImage, params)
+	if params.blur > 0 {
+		img = gaussianBlur(img, params.blur)
+	}
+	if params.unsharp != nil {
+		img = unsharpMask(img, params.unsharp)
+	}
+	if params.adjust != nil {
+		img = applyAdjustments(img, params.adjust)
+	}
+	if params.watermark != nil {
+		img = applyWatermark(img, params.watermark, resizeFilters[params.filter])
+	}
+	if params.text != nil {
+		img = applyText(img, params.text)
+	}
+	return encodeImage(img, params)
+}
+
+func transformImage(srcImage image.Image, params *resizeParams) image.Image {
+	filter := resizeFilters[params.filter]
+	width, height := uint(params.width), uint(params.height)
+	// Zero side is calculated by resize package keeping the aspect
+	// ratio so the modes matter only when both sides are set.
+	if width == 0 || height == 0 || params.mode == "stretch" {
+		return resize.Resize(width, height, srcImage, filter)
+	}
+	bounds := srcImage.Bounds()
+	scaleX := float64(width) / float64(bounds.Dx())
+	scaleY := float64(height) / float64(bounds.Dy())
+	if params.mode == "fit" {
+		if scaleX < scaleY {
+			return resize.Resize(width, 0, srcImage, filter)
+		}
+		return resize.Resize(0, height, srcImage, filter)
+	}
+	// Fill mode: scale by the larger side and crop the rest.
+	var resized image.Image
+	if scaleX > scaleY {
+		resized = resize.Resize(width, 0, srcImage, filter)
+	} else {
+		resized = resize.Resize(0, height, srcImage, filter)
+	}
+	return cropCenter(resized, int(width), int(height))
+}
+
+// Crops the rectangle of the size by the center of the image.
+func cropCenter(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-width)/2
+	y := bounds.Min.Y + (bounds.Dy()-height)/2
+	rect := image.Rect(x, y, x+width, y+height)
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	return img
+}
+
+func encodeImage(img image.Image, params *resizeParams) ([]byte, error) {
+	var (
+		buf = new(bytes.Buffer)
+		err error
+	)
+	switch params.format {
+	case "blurhash":
+		return []byte(encodeBlurHash(img, blurHashComponentsX, blurHashComponentsY)), nil
+	case "lqip":
+		return encodeLQIP(img)
+	case "png":
+		err = png.Encode(buf, img)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: params.quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/url"
+	"strconv"
+)
+
+const defaultTrimTolerance = 10
+
+// Trimming of uniform borders of the source. Pixels differing from
+// the reference colour in each channel not more than tolerance are
+// the border. Colour is nil for the top-left pixel of the source.
+type trimParams struct {
+	tolerance int
+	color     *color.NRGBA
+}
+
+// Parses `trim` parameter with `trim_tolerance` in levels 0..255 and
+// `trim_color` options.
+func parseTrim(args url.Values) (*trimParams, error) {
+	if args.Get("trim") == "" {
+		return nil, nil
+	}
+	trim, err := strconv.ParseBool(args.Get("trim"))
+	if err != nil {
+		return nil, errors.New("`trim` should be 0 or 1")
+	}
+	if !trim {
+		return nil, nil
+	}
+	p := &trimParams{tolerance: defaultTrimTolerance}
+	if args.Get("trim_tolerance") != "" {
+		if p.tolerance, err = strconv.Atoi(args.Get("trim_tolerance")); err != nil || p.tolerance < 0 || p.tolerance > 255 {
+			return nil, errors.New("`trim_tolerance` should be in range 0..255")
+		}
+	}
+	if args.Get("trim_color") != "" {
+		c, err := parseColor(args.Get("trim_color"))
+		if err != nil {
+			return nil, fmt.Errorf("`trim_color`: %s", err)
+		}
+		p.color = &c
+	}
+	return p, nil
+}
+
+// Part of the cache key.
+func (p *trimParams) String() string {
+	return fmt.Sprintf("%d,%s", p.tolerance, formatColor(p.color))
+}
+
+// Crops the borders of the reference colour. The image is kept as is
+// when it is uniform as a whole. Only the scanned pixels are
+// converted, the source is cropped without copying.
+func trimBorders(img image.Image, p *trimParams) image.Image {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return img
+	}
+	at := func(x, y int) color.RGBA {
+		return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+	var ref color.RGBA
+	if p.color != nil {
+		ref = color.RGBAModel.Convert(*p.color).(color.RGBA)
+	} else {
+		ref = at(bounds.Min.X, bounds.Min.Y)
+	}
+	border := func(x, y int) bool {
+		c := at(x, y)
+		return channelDiff(c.R, ref.R) <= p.tolerance && channelDiff(c.G, ref.G) <= p.tolerance &&
+			channelDiff(c.B, ref.B) <= p.tolerance && channelDiff(c.A, ref.A) <= p.tolerance
+	}
+	rowIsBorder := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	rect := bounds
+	for rect.Min.Y < rect.Max.Y && rowIsBorder(rect.Min.Y, rect.Min.X, rect.Max.X) {
+		rect.Min.Y++
+	}
+	if rect.Empty() {
+		return img
+	}
+	for rowIsBorder(rect.Max.Y-1, rect.Min.X, rect.Max.X) {
+		rect.Max.Y--
+	}
+	for colIsBorder(rect.Min.X, rect.Min.Y, rect.Max.Y) {
+		rect.Min.X++
+	}
+	for colIsBorder(rect.Max.X-1, rect.Min.Y, rect.Max.Y) {
+		rect.Max.X--
+	}
+	if rect == bounds {
+		return img
+	}
+	// All the decoded images of the standard library could be
+	// cropped in place.
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	return toRGBA(img).SubImage(rect)
+}
+
+func channelDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"testing"
+)
+
+// Red rectangle inside the border of the colour.
+func newBorderedImage(border color.Color, inner image.Rectangle) *image.RGBA {
+	img := newSolidImage(100, 80, border)
+	draw.Draw(img, inner, &image.Uniform{color.RGBA{0xff, 0, 0, 0xff}}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestTrimBorders(t *testing.T) {
+	inner := image.Rect(10, 5, 70, 60)
+	img := trimBorders(newBorderedImage(color.White, inner), &trimParams{})
+
+	assert.Equal(t, inner, img.Bounds())
+}
+
+func TestTrimBorders_Tolerance(t *testing.T) {
+	src := newBorderedImage(color.White, image.Rect(20, 20, 40, 40))
+	// Noise of the border as of JPEG artifacts.
+	src.Set(5, 5, color.RGBA{0xf5, 0xf8, 0xff, 0xff})
+
+	assert.Equal(t, image.Rect(5, 5, 40, 40), trimBorders(src, &trimParams{tolerance: 5}).Bounds())
+	assert.Equal(t, image.Rect(20, 20, 40, 40), trimBorders(src, &trimParams{tolerance: 10}).Bounds())
+}
+
+func TestTrimBorders_Color(t *testing.T) {
+	src := newBorderedImage(color.Black, image.Rect(0, 0, 50, 40))
+	black := color.NRGBA{0, 0, 0, 0xff}
+
+	// The top-left pixel is red so the black border is kept unless
+	// its colour is given.
+	assert.Equal(t, src.Bounds(), trimBorders(src, &trimParams{}).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 50, 40), trimBorders(src, &trimParams{color: &black}).Bounds())
+}
+
+func TestTrimBorders_KeepsSourceType(t *testing.T) {
+	// White YCbCr as decoded from JPEG with the black rectangle.
+	src := image.NewYCbCr(image.Rect(0, 0, 40, 30), image.YCbCrSubsampleRatio444)
+	for i := range src.Y {
+		src.Y[i], src.Cb[i], src.Cr[i] = 0xff, 0x80, 0x80
+	}
+	for y := 10; y < 20; y++ {
+		for x := 5; x < 25; x++ {
+			src.Y[src.YOffset(x, y)] = 0
+		}
+	}
+	img := trimBorders(src, &trimParams{})
+
+	assert.IsType(t, &image.YCbCr{}, img)
+	assert.Equal(t, image.Rect(5, 10, 25, 20), img.Bounds())
+}
+
+func TestTrimBorders_Uniform(t *testing.T) {
+	src := newSolidImage(30, 30, color.White)
+
+	assert.Equal(t, src.Bounds(), trimBorders(src, &trimParams{}).Bounds())
+}
+
+func TestParseTrim(t *testing.T) {
+	args, _ := url.ParseQuery("trim=1&trim_tolerance=20&trim_color=ffffff")
+	p, err := parseTrim(args)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "20,ffffffff", p.String())
+	args, _ = url.ParseQuery("trim=0&trim_tolerance=20")
+	p, err = parseTrim(args)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	for _, query := range []string{"trim=yes", "trim=1&trim_tolerance=256", "trim=1&trim_color=white"} {
+		args, _ = url.ParseQuery(query)
+		_, err = parseTrim(args)
+		assert.Error(t, err, query)
+	}
+}
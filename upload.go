@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Name of the form field with the image in multipart requests.
+const uploadFormField = "image"
+
+var errNoUploadedImage = errors.New("multipart request has no `image` field")
+
+// Handles POST to `/resize` with the image in the body: either raw
+// bytes or multipart form with `image` field. Parameters are in the
+// query string as for GET. Uploads are not cached by default because
+// nothing identifies them. With `cache=1` client sends SHA-256 of
+// the image in `hash` parameter, it is checked against the body and
+// used as the cache key.
+func handleUpload(w http.ResponseWriter, r *http.Request, params *resizeParams) {
+	args := r.URL.Query()
+	useCache := args.Get("cache") == "1"
+	if useCache && args.Get("hash") == "" {
+		http.Error(w, "400 request error: `hash` parameter is mandatory with `cache=1`", http.StatusBadRequest)
+		return
+	}
+	data, err := readUpload(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errSourceTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("%d upload error: %s", status, err), status)
+		return
+	}
+	// Set before the cache lookup as the cached result is written
+	// right away.
+	w.Header().Set("Content-Type", contentType(params.format))
+	var key []byte
+	if useCache {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(args.Get("hash"), hex.EncodeToString(sum[:])) {
+			http.Error(w, "400 request error: `hash` doesn't match the uploaded image", http.StatusBadRequest)
+			return
+		}
+		params.source = imageSource{path: "upload:" + hex.EncodeToString(sum[:])}
+		key = formatCacheKey(params)
+		// There is nothing to refresh stale result from, the
+		// image is here anyway.
+		if useServerCache(w, key, nil) {
+			return
+		}
+	}
+	srcImage, err := decodeImage(data)
+	if err == errSourceTooLarge {
+		http.Error(w, fmt.Sprintf("413 upload error: %s", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: uploaded image: %s", err), http.StatusBadRequest)
+		return
+	}
+	var result []byte
+	if result, err = processImage(srcImage, params); err != nil {
+		http.Error(w, fmt.Sprintf("400 request error: uploaded image: %s", err), http.StatusBadRequest)
+		return
+	}
+	w.Write(result)
+	if useCache {
+		storeResult(key, result)
+	}
+}
+
+// Reads the image from the body limited by `maxUploadSize`.
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return readLimited(r.Body, maxUploadSize)
+	}
+	// Form fields besides the image are skipped but they should
+	// not be endless too.
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxUploadSize)
+	data, err := readUploadPart(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errSourceTooLarge
+	}
+	return data, err
+}
+
+// Finds the image field in the multipart body.
+func readUploadPart(r *http.Request) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errNoUploadedImage
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == uploadFormField {
+			return readLimited(part, maxUploadSize)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+)
+
+// Overlay image registered in the config. The options are the
+// defaults for the requests with this watermark.
+type watermarkConfig struct {
+	// Image file, PNG with transparency is the best choice.
+	Path     string  `toml:"path"`
+	Position string  `toml:"position,omitempty"`
+	Margin   int     `toml:"margin,omitempty"`
+	Opacity  float64 `toml:"opacity,omitempty"`
+	Scale    float64 `toml:"scale,omitempty"`
+}
+
+// Decoded overlay kept in memory with its defaults.
+type watermarkImage struct {
+	img      image.Image
+	defaults watermarkConfig
+}
+
+// Watermark of the request: the overlay and the options of
+// compositing. Scale is the width of the overlay relative to the
+// width of the result, zero keeps the overlay as is.
+type watermarkParams struct {
+	name     string
+	img      image.Image
+	position string
+	margin   int
+	opacity  float64
+	scale    float64
+}
+
+// Positions of the watermark by the sides of the result.
+var watermarkPositions = map[string]image.Point{
+	"top-left": {-1, -1}, "top": {0, -1}, "top-right": {1, -1},
+	"left": {-1, 0}, "center": {0, 0}, "right": {1, 0},
+	"bottom-left": {-1, 1}, "bottom": {0, 1}, "bottom-right": {1, 1},
+}
+
+const defaultWatermarkPosition = "bottom-right"
+
+// Loads the overlays from the config.
+func setupWatermarks(configs map[string]watermarkConfig) (map[string]*watermarkImage, error) {
+	result := make(map[string]*watermarkImage, len(configs))
+	for name, cfg := range configs {
+		if cfg.Position == "" {
+			cfg.Position = defaultWatermarkPosition
+		}
+		if cfg.Opacity == 0 {
+			cfg.Opacity = 1
+		}
+		if err := checkWatermarkOptions(cfg); err != nil {
+			return nil, fmt.Errorf("watermark %q: %s", name, err)
+		}
+		data, err := ioutil.ReadFile(cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("watermark %q: %s", name, err)
+		}
+		img, err := decodeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("watermark %q: %s", name, err)
+		}
+		result[name] = &watermarkImage{img: img, defaults: cfg}
+	}
+	return result, nil
+}
+
+func checkWatermarkOptions(cfg watermarkConfig) error {
+	if _, ok := watermarkPositions[cfg.Position]; !ok {
+		return fmt.Errorf("unknown position %q", cfg.Position)
+	}
+	if cfg.Margin < 0 || cfg.Margin > defaultMaxSize {
+		return fmt.Errorf("margin should be in range 0..%d", defaultMaxSize)
+	}
+	// Negated so NaN is refused as well.
+	if !(cfg.Opacity > 0 && cfg.Opacity <= 1) {
+		return errors.New("opacity should be in range (0, 1]")
+	}
+	if !(cfg.Scale >= 0 && cfg.Scale <= 1) {
+		return errors.New("scale should be in range [0, 1]")
+	}
+	return nil
+}
+
+// Parses `watermark` parameter with `wm_position`, `wm_margin`,
+// `wm_opacity` and `wm_scale` options overriding the defaults of the
+// watermark.
+func (s *settings) parseWatermark(args url.Values) (*watermarkParams, error) {
+	name := args.Get("watermark")
+	if name == "" {
+		return nil, nil
+	}
+	wm, ok := s.watermarks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown watermark %q", name)
+	}
+	cfg := wm.defaults
+	var err error
+	if args.Get("wm_position") != "" {
+		cfg.Position = args.Get("wm_position")
+	}
+	if args.Get("wm_margin") != "" {
+		if cfg.Margin, err = strconv.Atoi(args.Get("wm_margin")); err != nil {
+			return nil, errors.New("`wm_margin` should be a number")
+		}
+	}
+	if args.Get("wm_opacity") != "" {
+		if cfg.Opacity, err = parseFloat(args.Get("wm_opacity")); err != nil {
+			return nil, errors.New("`wm_opacity` should be a number")
+		}
+	}
+	if args.Get("wm_scale") != "" {
+		if cfg.Scale, err = parseFloat(args.Get("wm_scale")); err != nil {
+			return nil, errors.New("`wm_scale` should be a number")
+		}
+	}
+	if err = checkWatermarkOptions(cfg); err != nil {
+		return nil, fmt.Errorf("watermark: %s", err)
+	}
+	return &watermarkParams{
+		name:     name,
+		img:      wm.img,
+		position: cfg.Position,
+		margin:   cfg.Margin,
+		opacity:  cfg.Opacity,
+		scale:    cfg.Scale,
+	}, nil
+}
+
+// Part of the cache key.
+func (p *watermarkParams) String() string {
+	return fmt.Sprintf("%s,%s,%d,%g,%g", p.name, p.position, p.margin, p.opacity, p.scale)
+}
+
+// Draws the watermark over the image. The overlay is scaled down when
+// it does not fit the image with the margins.
+func applyWatermark(img image.Image, p *watermarkParams, filter resize.InterpolationFunction) image.Image {
+	bounds := img.Bounds()
+	overlay := p.img
+	width := overlay.Bounds().Dx()
+	if p.scale > 0 {
+		width = int(p.scale * float64(bounds.Dx()))
+	}
+	maxWidth, maxHeight := bounds.Dx()-2*p.margin, bounds.Dy()-2*p.margin
+	if maxWidth <= 0 || maxHeight <= 0 {
+		return img
+	}
+	if width > maxWidth {
+		width = maxWidth
+	}
+	height := overlay.Bounds().Dy() * width / overlay.Bounds().Dx()
+	if height <= 0 {
+		return img
+	}
+	if height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if width <= 0 {
+		return img
+	}
+	if width != overlay.Bounds().Dx() || height != overlay.Bounds().Dy() {
+		overlay = resize.Resize(uint(width), uint(height), overlay, filter)
+	}
+	// Position is -1, 0 or 1 by each axis for the start, the middle
+	// and the end of the side.
+	pos := watermarkPositions[p.position]
+	x := bounds.Min.X + p.margin + (pos.X+1)*(bounds.Dx()-2*p.margin-width)/2
+	y := bounds.Min.Y + p.margin + (pos.Y+1)*(bounds.Dy()-2*p.margin-height)/2
+
+	dst := toDrawable(img)
+	mask := image.NewUniform(color.Alpha16{uint16(p.opacity * 0xffff)})
+	draw.DrawMask(dst, image.Rect(x, y, x+width, y+height), overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+// Returns the copy of the image to draw on. The image is never changed
+// in place: resizing to the same size returns the source itself and
+// the fallback is shared between the requests.
+func toDrawable(img image.Image) draw.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
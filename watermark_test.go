@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"github.com/stretchr/testify/assert"
+
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"testing"
+)
+
+func newSolidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestApplyWatermark_Position(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	p := &watermarkParams{img: newSolidImage(10, 10, red), position: "bottom-right", margin: 5, opacity: 1}
+	img := applyWatermark(newSolidImage(100, 100, color.White), p, resize.Bilinear)
+
+	assert.Equal(t, red, img.At(85, 85))
+	assert.Equal(t, red, img.At(94, 94))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(95, 95))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(84, 84))
+}
+
+func TestApplyWatermark_OpacityAndScale(t *testing.T) {
+	p := &watermarkParams{img: newSolidImage(10, 10, color.Black), position: "center", opacity: 0.5, scale: 0.5}
+	img := applyWatermark(newSolidImage(100, 60, color.White), p, resize.Bilinear)
+	r, _, _, _ := img.At(50, 30).RGBA()
+
+	// Overlay is 50x50 in the center.
+	assert.InDelta(t, 0x7fff, r, 0x200)
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(24, 30))
+	assert.NotEqual(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(25, 30))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(50, 4))
+}
+
+func TestApplyWatermark_FitsSmallImage(t *testing.T) {
+	p := &watermarkParams{img: newSolidImage(200, 100, color.Black), position: "top-left", margin: 2, opacity: 1}
+	img := applyWatermark(newSolidImage(50, 50, color.White), p, resize.Bilinear)
+
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(2, 2))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(47, 24))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(48, 2))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(2, 26))
+}
+
+func TestSetupWatermarks_Errors(t *testing.T) {
+	for name, cfg := range map[string]watermarkConfig{
+		"missing":  {Path: "testdata/not-existed.png"},
+		"notimage": {Path: "testdata/README.md"},
+		"position": {Path: "testdata/watermark.png", Position: "middle"},
+		"opacity":  {Path: "testdata/watermark.png", Opacity: 1.5},
+		"scale":    {Path: "testdata/watermark.png", Scale: -1},
+		"nan":      {Path: "testdata/watermark.png", Scale: math.NaN()},
+	} {
+		_, err := setupWatermarks(map[string]watermarkConfig{name: cfg})
+
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseWatermark_Errors(t *testing.T) {
+	s := &settings{watermarks: map[string]*watermarkImage{
+		"logo": {img: newSolidImage(10, 10, color.Black), defaults: watermarkConfig{Position: defaultWatermarkPosition, Opacity: 1}},
+	}}
+	for _, query := range []string{
+		"watermark=none",
+		"watermark=logo&wm_position=middle",
+		"watermark=logo&wm_margin=-1",
+		"watermark=logo&wm_opacity=0",
+		"watermark=logo&wm_opacity=NaN",
+		"watermark=logo&wm_scale=NaN",
+		"watermark=logo&wm_scale=Inf",
+	} {
+		args, _ := url.ParseQuery(query)
+		_, err := s.parseWatermark(args)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestApplyWatermark_MarginTooLarge(t *testing.T) {
+	p := &watermarkParams{img: newSolidImage(10, 10, color.Black), position: "center", margin: 50, opacity: 1}
+	img := applyWatermark(newSolidImage(100, 40, color.White), p, resize.Bilinear)
+
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(50, 20))
+}
+
+func TestApplyWatermark_KeepsSource(t *testing.T) {
+	src := newSolidImage(100, 100, color.White)
+	p := &watermarkParams{img: newSolidImage(10, 10, color.Black), position: "center", opacity: 1}
+	img := applyWatermark(src, p, resize.Bilinear)
+
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(50, 50))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, src.At(50, 50))
+}
+
+func TestProcessImage_KeepsSource(t *testing.T) {
+	src := newSolidImage(100, 100, color.White)
+	wm := &watermarkParams{img: newSolidImage(10, 10, color.Black), position: "center", opacity: 1}
+	params := &resizeParams{width: 100, height: 100, mode: "stretch", format: "png", filter: "bilinear", watermark: wm}
+	_, err := processImage(src, params)
+
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, src.At(50, 50))
+}